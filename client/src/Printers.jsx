@@ -13,16 +13,35 @@ import CameraIcon from './assets/images/camera.svg?react'
 import CloseIcon from './assets/images/close.svg?react'
 import NetworkInfoIcon from './assets/images/network.svg?react'
 
+const parseTags = (value) => (value || '').split(',').map((t) => t.trim()).filter((t) => t)
+
 function Printers() {
   const [printers, setPrinters] = useState([])
   const [settings, setSettings] = useState({})
 
   const [showAddPrinterModal, setShowAddPrinterModal] = useState(false)
 
-  const getPrinters = async () => {
-    const res = await fetch("/v1/api/printers")
-    const data = await res.json()
-    setPrinters(data)
+  const applyPrinterUpdate = (update) => {
+    setPrinters(prev => {
+      const idx = prev.findIndex(p => p.id == update.id)
+      if (idx < 0) {
+        return [...prev, update].sort((a, b) => (a.id > b.id ? -1 : 1))
+      }
+      const next = [...prev]
+      next[idx] = { ...prev[idx], ...update }
+      return next
+    })
+  }
+
+  const streamPrinters = () => {
+    const source = new EventSource("/v1/api/printers/stream")
+    source.addEventListener('snapshot', (e) => setPrinters(JSON.parse(e.data)))
+    source.addEventListener('printer', (e) => applyPrinterUpdate(JSON.parse(e.data)))
+    source.addEventListener('delete', (e) => {
+      const deleted = JSON.parse(e.data)
+      setPrinters(prev => prev.filter(p => p.id != deleted.id))
+    })
+    return source
   };
 
   const getSettings = async () => {
@@ -37,7 +56,8 @@ function Printers() {
         path: formData.get('cameraapi' + cam.id),
         type: formData.get('cameratype' + cam.id),
         camera_ip: formData.get('cameraip' + cam.id),
-        camera_port: parseInt(formData.get('cameraport' + cam.id))
+        camera_port: parseInt(formData.get('cameraport' + cam.id)),
+        scheme: cam.scheme
       }
     })
 
@@ -46,14 +66,22 @@ function Printers() {
       headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify({
         printer_name: formData.get('name'),
+        tags: parseTags(formData.get('tags')),
         moonraker_ip: formData.get('ip'),
         moonraker_port: parseInt(formData.get('port')),
+        moonraker_url: formData.get('url'),
+        moonraker_ca: formData.get('ca'),
+        insecure_skip_verify: formData.get('insecure') === 'on',
+        moonraker_api_key: formData.get('apikey'),
+        moonraker_username: formData.get('username'),
+        moonraker_password: formData.get('password'),
+        inject_auth: formData.get('injectauth') === 'on',
         cameras: camFields
       })
     })
 
     if (resp.status == 200) {
-      setPrinters([...printers, await resp.json()])
+      applyPrinterUpdate(await resp.json())
       setShowAddPrinterModal(false)
     } else {
 
@@ -63,9 +91,8 @@ function Printers() {
 
   useEffect(() => {
     getSettings()
-    getPrinters()
-    const timer = setInterval(getPrinters, 5000)
-    return () => clearInterval(timer)
+    const source = streamPrinters()
+    return () => source.close()
   }, []);
 
   return (
@@ -201,6 +228,28 @@ function CameraMpjegStream({ src }) {
   )
 }
 
+function PrintThumbnail({ printer }) {
+  const [failed, setFailed] = useState(false)
+
+  useEffect(() => {
+    setFailed(false)
+  }, [printer.stats.filename]);
+
+  if (failed) {
+    return (
+      <svg className='w-12 h-12 fill-green-500' xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24">
+        <path d="M7,2H17V8H19V13H16.5L13,17H11L7.5,13H5V8H7V2M10,22H2V20H10A1,1 0 0,0 11,19V18H13V19A3,3 0 0,1 10,22Z" />
+      </svg>
+    )
+  }
+
+  return (
+    <img className='w-12 h-12 object-contain'
+      src={'/v1/api/printers/' + printer.id + '/thumbnail?file=' + encodeURIComponent(printer.stats.filename)}
+      onError={() => setFailed(true)} />
+  )
+}
+
 function PrinterList({ printers }) {
   return (
     <div className='divide-y divide-gray-500  bg-gray-600 rounded-b'>
@@ -237,7 +286,8 @@ function PrinterCard({ printer }) {
         path: formData.get('cameraapi' + cam.id),
         type: formData.get('cameratype' + cam.id),
         camera_ip: formData.get('cameraip' + cam.id),
-        camera_port: parseInt(formData.get('cameraport' + cam.id))
+        camera_port: parseInt(formData.get('cameraport' + cam.id)),
+        scheme: cam.scheme
       }
     })
 
@@ -246,8 +296,20 @@ function PrinterCard({ printer }) {
       headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify({
         printer_name: formData.get('name'),
+        tags: parseTags(formData.get('tags')),
         moonraker_ip: formData.get('ip'),
         moonraker_port: parseInt(formData.get('port')),
+        moonraker_url: formData.get('url'),
+        moonraker_ca: formData.get('ca'),
+        insecure_skip_verify: formData.get('insecure') === 'on',
+        moonraker_api_key: formData.get('apikey'),
+        moonraker_username: formData.get('username'),
+        moonraker_password: formData.get('password'),
+        // empty secrets are left unchanged, removing them has to be asked for
+        clear_auth: formData.get('clearauth') === 'on' ||
+          (!!printer.printer.moonraker_username && !formData.get('username')),
+        clear_ca: !!printer.printer.moonraker_ca && !formData.get('ca'),
+        inject_auth: formData.get('injectauth') === 'on',
         cameras: camFields
       })
     })
@@ -260,16 +322,20 @@ function PrinterCard({ printer }) {
   }
 
   const emergencyStop = async (printerid) => {
-    const resp = fetch("printers/" + printerid + '/fluidd/printer/emergency_stop', {
-      method: 'POST'
+    const resp = fetch('/v1/api/printers/' + printerid + '/actions', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ action: 'emergency_stop' })
     })
 
     setEstopLoading(true)
   }
 
   const printAction = (printerid, action) => {
-    const resp = fetch("printers/" + printerid + '/fluidd/printer/print/' + action, {
-      method: 'POST'
+    const resp = fetch('/v1/api/printers/' + printerid + '/actions', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ action: action })
     })
 
     if (action == 'pause') {
@@ -279,6 +345,12 @@ function PrinterCard({ printer }) {
     }
   }
 
+  const setCleared = (printerid, cleared) => {
+    const resp = fetch('/v1/api/printers/' + printerid + '/cleared', {
+      method: cleared ? 'POST' : 'DELETE'
+    })
+  }
+
   const deletePrinter = (printerid) => {
     const resp = fetch('/v1/api/printers?id=' + printerid, {
       method: 'DELETE'
@@ -293,6 +365,10 @@ function PrinterCard({ printer }) {
   }
 
   const filePrintEta = (printer) => {
+    if (printer.eta) {
+      return printer.eta.remaining_seconds
+    }
+
     const printDuration = printer.stats.print_duration;
     const progressPercentage = printer.virtual_sdcard.progress;
 
@@ -357,9 +433,21 @@ function PrinterCard({ printer }) {
           {printer.printer.printer_name}
         </p>
 
-        <p className="text-base truncate text-left capitalize">
-          {printer.stats.state}
-        </p>
+        {(printer.klippy_state && printer.klippy_state !== 'ready') ? (
+          <p className="text-base text-left text-rose-400" title={printer.state_message}>
+            Klipper {printer.klippy_state}{printer.state_message ? ': ' + printer.state_message : ''}
+          </p>
+        ) : (
+          <p className="text-base truncate text-left capitalize">
+            {printer.stats.state}{printer.stalled && <span className="text-amber-400"> (stalled)</span>}
+          </p>
+        )}
+
+        {printer.alerts && printer.alerts.map((alert) => (
+          <p key={alert.id} className="text-sm text-left text-amber-400" title={alert.action_error || alert.action}>
+            {alert.message}
+          </p>
+        ))}
       </>
     )
 
@@ -382,9 +470,7 @@ function PrinterCard({ printer }) {
     <div className="flex flex-wrap items-center px-5 py-5 justify-center relative">
       <div className="flex-shrink-0">
         {isPrinting ? (
-          <svg className='w-12 h-12 fill-green-500' xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24">
-            <path d="M7,2H17V8H19V13H16.5L13,17H11L7.5,13H5V8H7V2M10,22H2V20H10A1,1 0 0,0 11,19V18H13V19A3,3 0 0,1 10,22Z" />
-          </svg>
+          <PrintThumbnail printer={printer} />
         ) : printer.stats.state !== 'standby' ?
 
           (
@@ -480,6 +566,12 @@ function PrinterCard({ printer }) {
 
         {printControls}
 
+        {!isPrinting && printer.stats.state !== 'offline' && (
+          <Button onClick={() => setCleared(printer.id, !printer.cleared)}>
+            <span>{printer.cleared ? 'Bed Cleared' : 'Mark Cleared'}</span>
+          </Button>
+        )}
+
       </div>
       <div>
         {printer.stats.state !== 'offline' && showCameras ?
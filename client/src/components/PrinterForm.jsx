@@ -23,7 +23,10 @@ function PrinterForm({ printer, printerAction, setModal, isEdit }) {
   }
 
   const discoverCameras = async (formData) => {
-    const res = await fetch("/v1/api/cameras?ip=" + formData.get('ip') + "&port=" + formData.get('port'))
+    // printers behind a url serve their cameras next to moonraker
+    const query = formData.get('url') ? "url=" + encodeURIComponent(formData.get('url')) :
+      "ip=" + formData.get('ip') + "&port=" + formData.get('port')
+    const res = await fetch("/v1/api/cameras?" + query)
     if (res.status == 200) {
       const cameras = await res.json()
       if (cameras && cameras.length > 0) {
@@ -50,6 +53,13 @@ function PrinterForm({ printer, printerAction, setModal, isEdit }) {
               name='name' 
               defaultValue={(printer && printer.printer.printer_name) || ''} />
           </label>
+          <label className="block">
+            Tags
+            <input className="text-input"
+              name='tags'
+              placeholder='optional, comma separated'
+              defaultValue={((printer && printer.printer.tags) || []).join(', ')} />
+          </label>
           <label className="block">
             Moonraker IP
             <input className="text-input read-only:bg-gray-500"
@@ -58,7 +68,7 @@ function PrinterForm({ printer, printerAction, setModal, isEdit }) {
               defaultValue={(printer && printer.printer.moonraker_ip) || '127.0.0.1'}
               readOnly={isEdit} />
           </label>
-          <label className="block pb-4">
+          <label className="block">
             Moonraker Port
             <input className="text-input read-only:bg-gray-500"
               name='port'
@@ -67,6 +77,61 @@ function PrinterForm({ printer, printerAction, setModal, isEdit }) {
               placeholder='7125'
               readOnly={isEdit} />
           </label>
+          <label className="block">
+            Moonraker URL
+            <input className="text-input read-only:bg-gray-500"
+              name='url'
+              placeholder='optional, e.g. https://host/moonraker-2/'
+              defaultValue={(printer && printer.printer.moonraker_url) || ''}
+              readOnly={isEdit} />
+          </label>
+          <label className="block">
+            Moonraker CA Certificate
+            <textarea className="text-input"
+              name='ca'
+              rows='2'
+              placeholder='optional PEM or file path'
+              defaultValue={(printer && printer.printer.moonraker_ca) || ''} />
+          </label>
+          <label className="flex items-center space-x-2">
+            <input type='checkbox'
+              name='insecure'
+              defaultChecked={(printer && printer.printer.insecure_skip_verify) || false} />
+            <span>Skip TLS certificate verification</span>
+          </label>
+          <label className="block">
+            Moonraker API Key
+            <input className="text-input"
+              name='apikey'
+              type='password'
+              placeholder={isEdit ? 'unchanged' : 'optional'} />
+          </label>
+          <label className="block">
+            Moonraker Username
+            <input className="text-input"
+              name='username'
+              placeholder='optional'
+              defaultValue={(printer && printer.printer.moonraker_username) || ''} />
+          </label>
+          <label className="block">
+            Moonraker Password
+            <input className="text-input"
+              name='password'
+              type='password'
+              placeholder={isEdit ? 'unchanged' : 'optional'} />
+          </label>
+          {isEdit &&
+            <label className="flex items-center space-x-2">
+              <input type='checkbox'
+                name='clearauth' />
+              <span>Remove the saved API key and login</span>
+            </label>}
+          <label className="flex items-center space-x-2 pb-4">
+            <input type='checkbox'
+              name='injectauth'
+              defaultChecked={(printer && printer.printer.inject_auth) || false} />
+            <span>Use these credentials for remote access</span>
+          </label>
           {cameras.map((cam, i) => {
             return (
               <div key={cam.id} className='border-t-2 border-dotted border-gray-400 space-y-2 py-4 relative'>
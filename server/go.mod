@@ -6,6 +6,7 @@ require (
 	github.com/NYTimes/gziphandler v1.1.1
 	github.com/ngrok/ngrok-api-go/v5 v5.4.1
 	golang.ngrok.com/ngrok v1.9.1
+	nhooyr.io/websocket v1.8.10
 	tailscale.com v1.68.2
 )
 
@@ -99,5 +100,4 @@ require (
 	google.golang.org/protobuf v1.33.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gvisor.dev/gvisor v0.0.0-20240306221502-ee1e1f6070e3 // indirect
-	nhooyr.io/websocket v1.8.10 // indirect
 )
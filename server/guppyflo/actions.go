@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const (
+	ActionPause         = "pause"
+	ActionResume        = "resume"
+	ActionCancel        = "cancel"
+	ActionEmergencyStop = "emergency_stop"
+)
+
+var PrinterActions = []string{ActionPause, ActionResume, ActionCancel, ActionEmergencyStop}
+
+type ActionRequest struct {
+	Action string `json:"action"`
+	// bulk only, printers listed by id and/or everything with the tag
+	Printers []string `json:"printers,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+}
+
+type ActionResult struct {
+	PrinterId string `json:"printer_id"`
+	Name      string `json:"printer_name,omitempty"`
+	Action    string `json:"action"`
+	Ok        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+func sendPrinterAction(p GTPrinterConfig, action string) error {
+	path := "/printer/print/" + action
+	if action == ActionEmergencyStop {
+		path = "/printer/emergency_stop"
+	}
+
+	resp, err := moonrakerRequest(p, http.MethodPost, path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &MoonrakerStatusError{Path: path, Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func runPrinterAction(printerId string, action string) ActionResult {
+	result := ActionResult{PrinterId: printerId, Action: action}
+
+	PrintersMapLock.RLock()
+	printer, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		result.Error = "printer not found"
+		return result
+	}
+	result.Name = printer.PrinterInfo.Name
+
+	if err := sendPrinterAction(printer.PrinterInfo, action); err != nil {
+		log.Println("Action", action, "failed for printer", printerId, err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Ok = true
+
+	// show the new state without waiting for the next poll
+	PrintersMapLock.RLock()
+	wakePrinterPoller(printerId)
+	PrintersMapLock.RUnlock()
+	return result
+}
+
+// ids of the requested printers plus every printer carrying the tag, in request order
+func actionTargets(req ActionRequest) []string {
+	targets := slices.Clone(req.Printers)
+	if req.Tag == "" {
+		return targets
+	}
+
+	PrintersMapLock.RLock()
+	defer PrintersMapLock.RUnlock()
+	for _, p := range getSortedPrinters() {
+		if slices.Contains(p.PrinterInfo.Tags, req.Tag) && !slices.Contains(targets, p.PrinterId) {
+			targets = append(targets, p.PrinterId)
+		}
+	}
+	return targets
+}
+
+func decodeActionRequest(w http.ResponseWriter, r *http.Request) (ActionRequest, bool) {
+	var req ActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode action json", http.StatusBadRequest)
+		return req, false
+	}
+	if !slices.Contains(PrinterActions, req.Action) {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func printerActionHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeActionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	_, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+
+	result := runPrinterAction(printerId, req.Action)
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ok {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(&result)
+}
+
+// runs the action on all targets at once, an e-stop shouldn't wait on a slow printer
+func bulkActionHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeActionRequest(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Printers) == 0 && req.Tag == "" {
+		http.Error(w, "Either printers or tag is required", http.StatusBadRequest)
+		return
+	}
+
+	targets := actionTargets(req)
+	results := make([]ActionResult, len(targets))
+	var wg sync.WaitGroup
+	for i, printerId := range targets {
+		wg.Add(1)
+		go func(i int, printerId string) {
+			defer wg.Done()
+			results[i] = runPrinterAction(printerId, req.Action)
+		}(i, printerId)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"action":  req.Action,
+		"results": results,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwt state for printers configured with a moonraker username/password
+type MoonrakerAuth struct {
+	lock         sync.Mutex
+	token        string
+	refreshToken string
+	expires      time.Time
+}
+
+type MoonrakerLoginResult struct {
+	Username     string `json:"username"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+var (
+	MoonrakerAuths     = make(map[string]*MoonrakerAuth)
+	MoonrakerAuthsLock sync.Mutex
+)
+
+func getMoonrakerAuth(printerId string) *MoonrakerAuth {
+	MoonrakerAuthsLock.Lock()
+	defer MoonrakerAuthsLock.Unlock()
+	auth, exists := MoonrakerAuths[printerId]
+	if !exists {
+		auth = &MoonrakerAuth{}
+		MoonrakerAuths[printerId] = auth
+	}
+	return auth
+}
+
+// drops cached tokens, e.g. after the printer's credentials changed
+func resetMoonrakerAuth(printerId string) {
+	MoonrakerAuthsLock.Lock()
+	defer MoonrakerAuthsLock.Unlock()
+	delete(MoonrakerAuths, printerId)
+}
+
+func hasMoonrakerCredentials(p GTPrinterConfig) bool {
+	return p.MoonrakerApiKey != "" || p.MoonrakerUsername != ""
+}
+
+// reads exp from the token payload, moonraker doesn't report it separately
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+func moonrakerAuthPost(p GTPrinterConfig, path string, body any) (*MoonrakerLoginResult, error) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := moonrakerClient(p)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Post(moonrakerUrl(p, path), "application/json", bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("moonraker login failed: " + resp.Status)
+	}
+
+	var result struct {
+		Result MoonrakerLoginResult `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Result, nil
+}
+
+func (a *MoonrakerAuth) jwt(p GTPrinterConfig) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.token != "" && time.Now().Add(time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+
+	if a.refreshToken != "" {
+		result, err := moonrakerAuthPost(p, "/access/refresh_jwt", map[string]string{
+			"refresh_token": a.refreshToken,
+		})
+		if err == nil {
+			a.token = result.Token
+			a.expires = jwtExpiry(result.Token)
+			return a.token, nil
+		}
+		// refresh token expired or revoked, log in again
+		a.refreshToken = ""
+	}
+
+	result, err := moonrakerAuthPost(p, "/access/login", map[string]string{
+		"username": p.MoonrakerUsername,
+		"password": p.MoonrakerPassword,
+		"source":   "moonraker",
+	})
+	if err != nil {
+		a.token = ""
+		return "", err
+	}
+
+	a.token = result.Token
+	a.refreshToken = result.RefreshToken
+	a.expires = jwtExpiry(result.Token)
+	return a.token, nil
+}
+
+func (a *MoonrakerAuth) invalidate() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.token = ""
+}
+
+// headers authenticating guppyflo against the printer's moonraker, empty when
+// the printer has no credentials configured
+func moonrakerAuthHeader(p GTPrinterConfig) (http.Header, error) {
+	header := make(http.Header)
+	if p.MoonrakerApiKey != "" {
+		header.Set("X-Api-Key", p.MoonrakerApiKey)
+		return header, nil
+	}
+
+	if p.MoonrakerUsername != "" {
+		token, err := getMoonrakerAuth(getPrinterId(p)).jwt(p)
+		if err != nil {
+			return header, err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header, nil
+}
+
+// adds guppyflo's credentials to proxied requests so remote users don't need them.
+// the printer config is looked up per request so credential changes apply right away.
+func injectMoonrakerAuth(proxy *httputil.ReverseProxy, printerId string) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+
+		PrintersMapLock.RLock()
+		printer, exists := Printers[printerId]
+		PrintersMapLock.RUnlock()
+		if !exists || printer.PrinterInfo.InjectAuth == nil || !*printer.PrinterInfo.InjectAuth {
+			return
+		}
+
+		// clients that bring their own credentials keep them
+		if req.Header.Get("X-Api-Key") != "" || req.Header.Get("Authorization") != "" {
+			return
+		}
+
+		header, err := moonrakerAuthHeader(printer.PrinterInfo)
+		if err != nil {
+			return
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const maxLatencySamples = 100
+
+type LatencyPercentiles struct {
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+	Samples int     `json:"samples"`
+}
+
+type PrinterDiagnostics struct {
+	// websocket or http, whichever the poller currently uses
+	Transport           string             `json:"transport"`
+	LastSuccess         int64              `json:"last_success,omitempty"`
+	LastError           string             `json:"last_error,omitempty"`
+	LastErrorKind       string             `json:"last_error_kind,omitempty"`
+	LastErrorTime       int64              `json:"last_error_time,omitempty"`
+	ConsecutiveFailures int                `json:"consecutive_failures"`
+	Latency             LatencyPercentiles `json:"latency"`
+}
+
+type diagnosticsRecorder struct {
+	diagnostics PrinterDiagnostics
+	// round trips in milliseconds, oldest first
+	latencies []float64
+}
+
+// moonraker answered with something other than 200
+type MoonrakerStatusError struct {
+	Path       string
+	Status     string
+	StatusCode int
+}
+
+func (e *MoonrakerStatusError) Error() string {
+	return fmt.Sprintf("moonraker request %s failed: %s", e.Path, e.Status)
+}
+
+var (
+	Diagnostics     = make(map[string]*diagnosticsRecorder)
+	DiagnosticsLock sync.Mutex
+)
+
+// callers must hold DiagnosticsLock
+func getDiagnosticsRecorder(printerId string) *diagnosticsRecorder {
+	d, exists := Diagnostics[printerId]
+	if !exists {
+		d = &diagnosticsRecorder{}
+		Diagnostics[printerId] = d
+	}
+	return d
+}
+
+func recordPollSuccess(printerId string, transport string, latency time.Duration) {
+	DiagnosticsLock.Lock()
+	defer DiagnosticsLock.Unlock()
+	d := getDiagnosticsRecorder(printerId)
+	d.diagnostics.Transport = transport
+	d.diagnostics.LastSuccess = time.Now().Unix()
+	d.diagnostics.ConsecutiveFailures = 0
+
+	// pushed updates have no round trip to measure
+	if latency > 0 {
+		d.latencies = append(d.latencies, float64(latency.Microseconds())/1000)
+		if len(d.latencies) > maxLatencySamples {
+			d.latencies = d.latencies[len(d.latencies)-maxLatencySamples:]
+		}
+	}
+}
+
+func recordPollFailure(printerId string, transport string, err error) {
+	DiagnosticsLock.Lock()
+	defer DiagnosticsLock.Unlock()
+	d := getDiagnosticsRecorder(printerId)
+	d.diagnostics.Transport = transport
+	d.diagnostics.LastError = err.Error()
+	d.diagnostics.LastErrorKind = classifyPollError(err)
+	d.diagnostics.LastErrorTime = time.Now().Unix()
+	d.diagnostics.ConsecutiveFailures++
+}
+
+func deletePrinterDiagnostics(printerId string) {
+	DiagnosticsLock.Lock()
+	defer DiagnosticsLock.Unlock()
+	delete(Diagnostics, printerId)
+}
+
+func getPrinterDiagnostics(printerId string) *PrinterDiagnostics {
+	DiagnosticsLock.Lock()
+	defer DiagnosticsLock.Unlock()
+	d, exists := Diagnostics[printerId]
+	if !exists {
+		return nil
+	}
+
+	diagnostics := d.diagnostics
+	diagnostics.Latency = latencyPercentiles(d.latencies)
+	return &diagnostics
+}
+
+// fills in Diagnostics for api responses and the stream
+func addPrinterDiagnostics(printers []PrinterInfoStatsPair) {
+	for i := range printers {
+		printers[i].Diagnostics = getPrinterDiagnostics(printers[i].PrinterId)
+	}
+}
+
+func latencyPercentiles(latencies []float64) LatencyPercentiles {
+	if len(latencies) == 0 {
+		return LatencyPercentiles{}
+	}
+
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	// nearest rank
+	percentile := func(p float64) float64 {
+		idx := int(p*float64(len(sorted))+0.5) - 1
+		return sorted[min(max(idx, 0), len(sorted)-1)]
+	}
+	return LatencyPercentiles{
+		P50:     percentile(0.5),
+		P90:     percentile(0.9),
+		P99:     percentile(0.99),
+		Samples: len(sorted),
+	}
+}
+
+// coarse reason a poll failed, good enough to tell a powered off printer from a misconfigured one
+func classifyPollError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var statusErr *MoonrakerStatusError
+	var rpcErr *JsonRpcError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var closeErr websocket.CloseError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return "tls"
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden {
+			return "auth"
+		}
+		return "http"
+	case errors.As(err, &rpcErr):
+		return "rpc"
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return "decode"
+	case errors.As(err, &closeErr):
+		return "closed"
+	}
+	return "other"
+}
+
+func printerDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	_, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+
+	diagnostics := getPrinterDiagnostics(printerId)
+	if diagnostics == nil {
+		// nothing polled yet
+		diagnostics = &PrinterDiagnostics{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(diagnostics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
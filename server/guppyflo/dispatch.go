@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DispatchPending   = "pending"
+	DispatchUploading = "uploading"
+	DispatchUploaded  = "uploaded"
+	DispatchPrinting  = "printing"
+	DispatchQueued    = "queued"
+	DispatchFailed    = "failed"
+
+	// uploads share the uplink, a few at a time is as fast as all at once
+	maxParallelUploads = 4
+	uploadTimeout      = 30 * time.Minute
+	// finished dispatches are kept around this long for clients to look up
+	dispatchRetention = time.Hour
+)
+
+var gcodeExtensions = []string{".gcode", ".g", ".gco", ".ufp", ".nc"}
+
+type DispatchTarget struct {
+	PrinterId string `json:"printer_id"`
+	Name      string `json:"printer_name,omitempty"`
+	State     string `json:"state"`
+	Sent      int64  `json:"sent"`
+	Error     string `json:"error,omitempty"`
+}
+
+type Dispatch struct {
+	Id       string           `json:"id"`
+	Filename string           `json:"filename"`
+	Size     int64            `json:"size"`
+	Start    bool             `json:"start"`
+	Created  int64            `json:"created"`
+	Done     bool             `json:"done"`
+	Targets  []DispatchTarget `json:"targets"`
+
+	lock sync.Mutex
+	// closed and replaced on every change, wakes up streaming clients
+	updated  chan struct{}
+	finished time.Time
+}
+
+var (
+	Dispatches     = make(map[string]*Dispatch)
+	DispatchesLock sync.Mutex
+)
+
+type UploadedFile struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+func uploadsDir() string {
+	return filepath.Join(filepath.Dir(configPath), "uploads")
+}
+
+// file name of an upload with any directories stripped, empty when it isn't g-code
+func uploadFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if strings.HasPrefix(name, ".") || !slices.Contains(gcodeExtensions, strings.ToLower(filepath.Ext(name))) {
+		return ""
+	}
+	return name
+}
+
+func (d *Dispatch) snapshot() Dispatch {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return Dispatch{
+		Id:       d.Id,
+		Filename: d.Filename,
+		Size:     d.Size,
+		Start:    d.Start,
+		Created:  d.Created,
+		Done:     d.Done,
+		Targets:  slices.Clone(d.Targets),
+	}
+}
+
+// callers must hold d.lock
+func (d *Dispatch) notify() {
+	close(d.updated)
+	d.updated = make(chan struct{})
+}
+
+func (d *Dispatch) update(i int, f func(t *DispatchTarget)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	f(&d.Targets[i])
+	d.notify()
+}
+
+// counts bytes read from an upload and reports every percent of progress
+type uploadProgressReader struct {
+	reader   io.Reader
+	size     int64
+	sent     int64
+	reported int64
+	progress func(sent int64)
+}
+
+func (r *uploadProgressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.sent += int64(n)
+	if r.sent == r.size || (r.sent-r.reported)*100 >= r.size {
+		r.reported = r.sent
+		r.progress(r.sent)
+	}
+	return n, err
+}
+
+type moonrakerUploadResult struct {
+	PrintStarted bool `json:"print_started"`
+	PrintQueued  bool `json:"print_queued"`
+}
+
+// sends a file to moonraker's server/files/upload. the multipart envelope is
+// built up front so moonraker gets a content length instead of a chunked body.
+func moonrakerUploadFile(ctx context.Context, p GTPrinterConfig, root string, filename string, content io.Reader, size int64, start bool) (moonrakerUploadResult, error) {
+	var result moonrakerUploadResult
+
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	mw.WriteField("root", root)
+	// moonraker wants sub directories separately from the file name
+	if dir := path.Dir(filename); dir != "." {
+		mw.WriteField("path", dir)
+	}
+	if start {
+		mw.WriteField("print", "true")
+	}
+	if _, err := mw.CreateFormFile("file", path.Base(filename)); err != nil {
+		return result, err
+	}
+	tail := "\r\n--" + mw.Boundary() + "--\r\n"
+
+	body := io.MultiReader(bytes.NewReader(head.Bytes()), content, strings.NewReader(tail))
+	resp, err := moonrakerTransfer(ctx, p, http.MethodPost, "/server/files/upload", body,
+		int64(head.Len())+size+int64(len(tail)), mw.FormDataContentType())
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return result, &MoonrakerStatusError{Path: "/server/files/upload", Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+func (d *Dispatch) uploadTo(i int) {
+	printerId := d.Targets[i].PrinterId
+	fail := func(err error) {
+		log.Println("Dispatch of", d.Filename, "to printer", printerId, "failed", err)
+		d.update(i, func(t *DispatchTarget) {
+			t.State = DispatchFailed
+			t.Error = err.Error()
+		})
+	}
+
+	PrintersMapLock.RLock()
+	printer, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		fail(errors.New("printer not found"))
+		return
+	}
+
+	f, err := os.Open(filepath.Join(uploadsDir(), d.Filename))
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer f.Close()
+	// the upload may have been replaced since, send whatever is there now
+	info, err := f.Stat()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	d.update(i, func(t *DispatchTarget) {
+		t.State = DispatchUploading
+	})
+
+	reader := &uploadProgressReader{reader: f, size: info.Size(), progress: func(sent int64) {
+		d.update(i, func(t *DispatchTarget) {
+			t.Sent = sent
+		})
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	result, err := moonrakerUploadFile(ctx, printer.PrinterInfo, "gcodes", d.Filename, reader, info.Size(), d.Start)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if d.Start && !result.PrintStarted && !result.PrintQueued {
+		fail(errors.New("uploaded, but moonraker didn't start the print"))
+		return
+	}
+
+	d.update(i, func(t *DispatchTarget) {
+		switch {
+		case result.PrintStarted:
+			t.State = DispatchPrinting
+		case result.PrintQueued:
+			t.State = DispatchQueued
+		default:
+			t.State = DispatchUploaded
+		}
+	})
+
+	if result.PrintStarted {
+		PrintersMapLock.RLock()
+		wakePrinterPoller(printerId)
+		PrintersMapLock.RUnlock()
+	}
+}
+
+func (d *Dispatch) run() {
+	limit := make(chan bool, maxParallelUploads)
+	var wg sync.WaitGroup
+	for i := range d.Targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			limit <- true
+			defer func() { <-limit }()
+			d.uploadTo(i)
+		}(i)
+	}
+	wg.Wait()
+
+	d.lock.Lock()
+	d.Done = true
+	d.finished = time.Now()
+	d.notify()
+	d.lock.Unlock()
+}
+
+func startDispatch(filename string, size int64, start bool, targets []string) *Dispatch {
+	d := &Dispatch{
+		Id:       newEventId(),
+		Filename: filename,
+		Size:     size,
+		Start:    start,
+		Created:  time.Now().Unix(),
+		Targets:  make([]DispatchTarget, len(targets)),
+		updated:  make(chan struct{}),
+	}
+
+	PrintersMapLock.RLock()
+	for i, printerId := range targets {
+		d.Targets[i] = DispatchTarget{PrinterId: printerId, State: DispatchPending}
+		if p, exists := Printers[printerId]; exists {
+			d.Targets[i].Name = p.PrinterInfo.Name
+		}
+	}
+	PrintersMapLock.RUnlock()
+
+	DispatchesLock.Lock()
+	for id, old := range Dispatches {
+		old.lock.Lock()
+		expired := old.Done && time.Since(old.finished) > dispatchRetention
+		old.lock.Unlock()
+		if expired {
+			delete(Dispatches, id)
+		}
+	}
+	Dispatches[d.Id] = d
+	DispatchesLock.Unlock()
+
+	go d.run()
+	return d
+}
+
+// streams the multipart body straight to disk, the file part may come before or after the fields
+func saveDispatchUpload(r *http.Request) (ActionRequest, string, bool, error) {
+	var req ActionRequest
+	var filename string
+	start := false
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return req, "", false, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return req, "", false, err
+		}
+
+		if part.FormName() == "file" {
+			filename = uploadFilename(part.FileName())
+			if filename == "" {
+				return req, "", false, errors.New("only g-code files can be dispatched")
+			}
+			if err := saveUpload(filename, part); err != nil {
+				return req, "", false, err
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, 64*1024))
+		if err != nil {
+			return req, "", false, err
+		}
+		switch part.FormName() {
+		case "filename":
+			// reuse an earlier upload
+			if filename == "" {
+				filename = uploadFilename(string(value))
+			}
+		case "printers":
+			for _, id := range strings.Split(string(value), ",") {
+				if id = strings.TrimSpace(id); id != "" {
+					req.Printers = append(req.Printers, id)
+				}
+			}
+		case "tag":
+			req.Tag = strings.TrimSpace(string(value))
+		case "start":
+			start = string(value) == "true" || string(value) == "on"
+		}
+	}
+	return req, filename, start, nil
+}
+
+func saveUpload(filename string, content io.Reader) error {
+	if err := os.MkdirAll(uploadsDir(), 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(uploadsDir(), "upload-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := io.Copy(tmpFile, content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(uploadsDir(), filename))
+}
+
+func dispatchHandler(w http.ResponseWriter, r *http.Request) {
+	req, filename, start, err := saveDispatchUpload(r)
+	if err != nil {
+		log.Println("Failed to receive dispatch upload", err)
+		http.Error(w, "Failed to receive upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filename == "" {
+		http.Error(w, "Either a file or the filename of an earlier upload is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Printers) == 0 && req.Tag == "" {
+		http.Error(w, "Either printers or tag is required", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(filepath.Join(uploadsDir(), filename))
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	d := startDispatch(filename, info.Size(), start, actionTargets(req))
+	snapshot := d.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&snapshot)
+}
+
+func getDispatch(w http.ResponseWriter, r *http.Request) (*Dispatch, bool) {
+	DispatchesLock.Lock()
+	d, exists := Dispatches[r.PathValue("dispatchId")]
+	DispatchesLock.Unlock()
+	if !exists {
+		http.Error(w, "dispatch not found", http.StatusNotFound)
+	}
+	return d, exists
+}
+
+func dispatchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	d, exists := getDispatch(w, r)
+	if !exists {
+		return
+	}
+
+	snapshot := d.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&snapshot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// sends the whole dispatch on every change until all uploads are finished
+func dispatchStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	d, exists := getDispatch(w, r)
+	if !exists {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	for {
+		d.lock.Lock()
+		updated := d.updated
+		d.lock.Unlock()
+
+		snapshot := d.snapshot()
+		if err := writeStreamEvent(w, PrinterStreamEvent{Type: "dispatch", Data: &snapshot}); err != nil {
+			return
+		}
+		flusher.Flush()
+		if snapshot.Done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updated:
+		}
+	}
+}
+
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(uploadsDir())
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uploads := make([]UploadedFile, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || uploadFilename(e.Name()) == "" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		uploads = append(uploads, UploadedFile{Filename: e.Name(), Size: info.Size(), Modified: info.ModTime().Unix()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&uploads)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// stores a g-code file for later dispatches or queue jobs
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Failed to receive upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	filename := uploadFilename(header.Filename)
+	if filename == "" {
+		http.Error(w, "only g-code files can be uploaded", http.StatusBadRequest)
+		return
+	}
+	if err := saveUpload(filename, file); err != nil {
+		log.Println("Failed to save upload", filename, err)
+		http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+		return
+	}
+
+	info, err := os.Stat(filepath.Join(uploadsDir(), filename))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&UploadedFile{Filename: filename, Size: info.Size(), Modified: info.ModTime().Unix()})
+}
+
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	filename := uploadFilename(r.PathValue("filename"))
+	if filename == "" || filename != r.PathValue("filename") {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	if err := os.Remove(filepath.Join(uploadsDir(), filename)); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to delete %s: %s", filename, err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NotifierEmail = "email"
+
+	SmtpStartTls = "starttls"
+	SmtpTls      = "tls"
+	SmtpNone     = "none"
+
+	smtpTimeout = 30 * time.Second
+)
+
+type EmailNotifier struct {
+	config GTNotifierConfig
+}
+
+func (n *EmailNotifier) Notify(msg Notification) error {
+	var snapshot []byte
+	if msg.Event.Type != EventOffline {
+		s, err := printerSnapshot(msg.Event.Printer.Id)
+		if err != nil {
+			log.Println("Sending email without snapshot for printer", msg.Event.Printer.Id, err)
+		}
+		snapshot = s
+	}
+
+	content, err := buildEmail(*n.config.Smtp, msg, snapshot)
+	if err != nil {
+		return err
+	}
+	return sendEmail(*n.config.Smtp, content)
+}
+
+func emailBody(msg Notification) string {
+	var b strings.Builder
+	b.WriteString(msg.Message + "\r\n\r\n")
+	fmt.Fprintf(&b, "Printer: %s\r\n", msg.Event.Printer.Name)
+	fmt.Fprintf(&b, "State: %s\r\n", msg.Event.State)
+	if job := msg.Event.Job; job != nil {
+		fmt.Fprintf(&b, "Job: %s\r\n", job.Filename)
+		fmt.Fprintf(&b, "Duration: %s\r\n", (time.Duration(job.PrintDuration) * time.Second).String())
+		fmt.Fprintf(&b, "Filament used: %.2fm\r\n", job.FilamentUsed/1000)
+		if job.Message != "" {
+			fmt.Fprintf(&b, "Message: %s\r\n", job.Message)
+		}
+	}
+	return b.String()
+}
+
+// base64 wrapped at 76 characters as MIME wants it
+func wrapBase64(content []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	return b.String()
+}
+
+func buildEmail(c GTSmtpConfig, msg Notification, snapshot []byte) ([]byte, error) {
+	if c.From == "" || len(c.To) == 0 {
+		return nil, errors.New("email notifier needs from and to addresses")
+	}
+
+	boundaryBytes := make([]byte, 12)
+	rand.Read(boundaryBytes)
+	boundary := "guppyflo-" + hex.EncodeToString(boundaryBytes)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", c.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	b.WriteString(wrapBase64([]byte(emailBody(msg))))
+
+	if len(snapshot) > 0 {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		b.WriteString("Content-Type: image/jpeg; name=\"snapshot.jpg\"\r\n")
+		b.WriteString("Content-Disposition: attachment; filename=\"snapshot.jpg\"\r\n")
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		b.WriteString(wrapBase64(snapshot))
+	}
+
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+func sendEmail(c GTSmtpConfig, content []byte) error {
+	port := c.Port
+	if port == 0 {
+		port = 587
+		if c.Security == SmtpTls {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: c.Host}
+
+	var conn net.Conn
+	var err error
+	if c.Security == SmtpTls {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, smtpTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if c.Security == "" || c.Security == SmtpStartTls {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server doesn't support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	// net/smtp refuses to send the password over an unencrypted connection
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		rcpt, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		if err := client.Rcpt(rcpt.Address); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
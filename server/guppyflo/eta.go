@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"time"
+)
+
+const (
+	EtaSlicer   = "slicer"
+	EtaFile     = "file"
+	EtaFilament = "filament"
+)
+
+var EtaMethods = []string{EtaSlicer, EtaFile, EtaFilament}
+
+type GcodeMetadata struct {
+	Filename         string           `json:"filename"`
+	Modified         float64          `json:"modified"`
+	Size             int              `json:"size"`
+	EstimatedTime    float64          `json:"estimated_time"`
+	FilamentTotal    float64          `json:"filament_total"`
+	LayerCount       int              `json:"layer_count"`
+	LayerHeight      float64          `json:"layer_height"`
+	FirstLayerHeight float64          `json:"first_layer_height"`
+	ObjectHeight     float64          `json:"object_height"`
+	GcodeStartByte   int              `json:"gcode_start_byte"`
+	GcodeEndByte     int              `json:"gcode_end_byte"`
+	Thumbnails       []GcodeThumbnail `json:"thumbnails"`
+}
+
+type PrintEstimate struct {
+	Method           string  `json:"method"`
+	RemainingSeconds float64 `json:"remaining_seconds"`
+	FinishTime       int64   `json:"finish_time"`
+	EstimatedTime    float64 `json:"estimated_time,omitempty"`
+	LayerCount       int     `json:"layer_count,omitempty"`
+}
+
+func getGcodeMetadata(p GTPrinterConfig, filename string) (*GcodeMetadata, error) {
+	var metadata GcodeMetadata
+	err := moonrakerGetResult(p, "/server/files/metadata?filename="+url.QueryEscape(filename), &metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// share of the file's gcode already run. the slicer header before gcode_start_byte
+// and the config dump after gcode_end_byte take no printing time.
+func fileProgress(sdcard VirtualSDCard, metadata *GcodeMetadata) float64 {
+	if metadata == nil || metadata.GcodeEndByte <= metadata.GcodeStartByte || sdcard.FilePosition == 0 {
+		return sdcard.Progress
+	}
+	position := float64(sdcard.FilePosition - metadata.GcodeStartByte)
+	return min(max(position/float64(metadata.GcodeEndByte-metadata.GcodeStartByte), 0), 1)
+}
+
+// estimateRemaining falls back to file position when the preferred method has
+// nothing to work with, e.g. a file sliced without estimates
+func estimateRemaining(method string, stats PrinterStats, sdcard VirtualSDCard, metadata *GcodeMetadata) (string, float64, bool) {
+	progress := fileProgress(sdcard, metadata)
+	switch method {
+	case EtaSlicer:
+		// the slicer's time for the part of the file that is left, so heating and
+		// pauses that the slicer didn't count don't eat into the estimate
+		if metadata != nil && metadata.EstimatedTime > 0 {
+			return EtaSlicer, metadata.EstimatedTime * (1 - progress), true
+		}
+	case EtaFilament:
+		if metadata != nil && metadata.FilamentTotal > 0 && stats.Filamentused > 0 {
+			ratio := min(stats.Filamentused/metadata.FilamentTotal, 1)
+			return EtaFilament, stats.PrintDuration/ratio - stats.PrintDuration, true
+		}
+	}
+
+	if progress > 0 {
+		return EtaFile, stats.PrintDuration/progress - stats.PrintDuration, true
+	}
+	return "", 0, false
+}
+
+func printEstimate(p GTPrinterConfig, stats PrinterStats, sdcard VirtualSDCard, metadata *GcodeMetadata) *PrintEstimate {
+	if stats.State != "printing" && stats.State != "paused" {
+		return nil
+	}
+
+	method := p.EtaMethod
+	if method == "" {
+		method = EtaSlicer
+	}
+
+	method, remaining, ok := estimateRemaining(method, stats, sdcard, metadata)
+	if !ok {
+		return nil
+	}
+
+	estimate := &PrintEstimate{
+		Method:           method,
+		RemainingSeconds: remaining,
+		FinishTime:       time.Now().Add(time.Duration(remaining) * time.Second).Unix(),
+	}
+	if metadata != nil {
+		estimate.EstimatedTime = metadata.EstimatedTime
+		estimate.LayerCount = metadata.LayerCount
+	}
+	return estimate
+}
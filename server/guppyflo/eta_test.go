@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateRemaining(t *testing.T) {
+	sliced := &GcodeMetadata{EstimatedTime: 3600, FilamentTotal: 1000, GcodeStartByte: 100, GcodeEndByte: 1100}
+	halfway := VirtualSDCard{FilePosition: 600, Progress: 0.55}
+
+	tests := []struct {
+		name          string
+		method        string
+		stats         PrinterStats
+		sdcard        VirtualSDCard
+		metadata      *GcodeMetadata
+		wantMethod    string
+		wantRemaining float64
+		wantOk        bool
+	}{
+		{
+			name:          "slicer time for the rest of the gcode",
+			method:        EtaSlicer,
+			stats:         PrinterStats{PrintDuration: 2400},
+			sdcard:        halfway,
+			metadata:      sliced,
+			wantMethod:    EtaSlicer,
+			wantRemaining: 1800,
+			wantOk:        true,
+		},
+		{
+			name:          "slicer before any progress",
+			method:        EtaSlicer,
+			metadata:      sliced,
+			wantMethod:    EtaSlicer,
+			wantRemaining: 3600,
+			wantOk:        true,
+		},
+		{
+			name:          "slicer without metadata falls back to file",
+			method:        EtaSlicer,
+			stats:         PrinterStats{PrintDuration: 600},
+			sdcard:        VirtualSDCard{FilePosition: 300, Progress: 0.25},
+			wantMethod:    EtaFile,
+			wantRemaining: 1800,
+			wantOk:        true,
+		},
+		{
+			name:          "slicer without an estimate falls back to file",
+			method:        EtaSlicer,
+			stats:         PrinterStats{PrintDuration: 600},
+			sdcard:        halfway,
+			metadata:      &GcodeMetadata{GcodeStartByte: 100, GcodeEndByte: 1100},
+			wantMethod:    EtaFile,
+			wantRemaining: 600,
+			wantOk:        true,
+		},
+		{
+			name:          "file progress skips the header and config dump",
+			method:        EtaFile,
+			stats:         PrinterStats{PrintDuration: 600},
+			sdcard:        halfway,
+			metadata:      sliced,
+			wantMethod:    EtaFile,
+			wantRemaining: 600,
+			wantOk:        true,
+		},
+		{
+			name:     "file position still in the header",
+			method:   EtaFile,
+			stats:    PrinterStats{PrintDuration: 30},
+			sdcard:   VirtualSDCard{FilePosition: 50, Progress: 0.05},
+			metadata: sliced,
+			wantOk:   false,
+		},
+		{
+			name:   "file with zero progress",
+			method: EtaFile,
+			stats:  PrinterStats{PrintDuration: 30},
+			wantOk: false,
+		},
+		{
+			name:          "filament used so far",
+			method:        EtaFilament,
+			stats:         PrinterStats{PrintDuration: 600, Filamentused: 250},
+			sdcard:        halfway,
+			metadata:      sliced,
+			wantMethod:    EtaFilament,
+			wantRemaining: 1800,
+			wantOk:        true,
+		},
+		{
+			name:          "filament before any extrusion falls back to file",
+			method:        EtaFilament,
+			stats:         PrinterStats{PrintDuration: 600},
+			sdcard:        halfway,
+			metadata:      sliced,
+			wantMethod:    EtaFile,
+			wantRemaining: 600,
+			wantOk:        true,
+		},
+		{
+			name:          "filament without metadata falls back to file",
+			method:        EtaFilament,
+			stats:         PrinterStats{PrintDuration: 600, Filamentused: 250},
+			sdcard:        VirtualSDCard{FilePosition: 300, Progress: 0.25},
+			wantMethod:    EtaFile,
+			wantRemaining: 1800,
+			wantOk:        true,
+		},
+		{
+			name:          "filament past the slicer total",
+			method:        EtaFilament,
+			stats:         PrinterStats{PrintDuration: 600, Filamentused: 1200},
+			sdcard:        halfway,
+			metadata:      sliced,
+			wantMethod:    EtaFilament,
+			wantRemaining: 0,
+			wantOk:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, remaining, ok := estimateRemaining(tt.method, tt.stats, tt.sdcard, tt.metadata)
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if method != tt.wantMethod || math.Abs(remaining-tt.wantRemaining) > 1e-9 {
+				t.Errorf("estimate = %s %v, want %s %v", method, remaining, tt.wantMethod, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestPrintEstimate(t *testing.T) {
+	metadata := &GcodeMetadata{EstimatedTime: 3600, LayerCount: 120}
+	printing := PrinterStats{State: "printing", PrintDuration: 600}
+	sdcard := VirtualSDCard{Progress: 0.5}
+
+	if e := printEstimate(GTPrinterConfig{}, PrinterStats{State: "standby"}, sdcard, metadata); e != nil {
+		t.Errorf("estimate while idle = %+v", e)
+	}
+
+	e := printEstimate(GTPrinterConfig{}, printing, sdcard, metadata)
+	if e == nil || e.Method != EtaSlicer || e.RemainingSeconds != 1800 || e.EstimatedTime != 3600 || e.LayerCount != 120 {
+		t.Errorf("default estimate = %+v, want the slicer's", e)
+	}
+
+	e = printEstimate(GTPrinterConfig{EtaMethod: EtaFile}, printing, sdcard, nil)
+	if e == nil || e.Method != EtaFile || e.RemainingSeconds != 600 || e.LayerCount != 0 {
+		t.Errorf("file estimate without metadata = %+v", e)
+	}
+
+	if e := printEstimate(GTPrinterConfig{}, printing, VirtualSDCard{}, nil); e != nil {
+		t.Errorf("estimate without progress or metadata = %+v", e)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	EventPrintStarted   = "print_started"
+	EventPrintComplete  = "print_complete"
+	EventPrintError     = "print_error"
+	EventPrintCancelled = "print_cancelled"
+	EventPaused         = "paused"
+	EventOffline        = "offline"
+	EventOnline         = "online"
+	EventAlert          = "alert"
+)
+
+var EventTypes = []string{EventPrintStarted, EventPrintComplete, EventPrintError,
+	EventPrintCancelled, EventPaused, EventOffline, EventOnline, EventAlert}
+
+type EventPrinter struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type EventJob struct {
+	Filename      string  `json:"filename"`
+	Progress      float64 `json:"progress"`
+	PrintDuration float64 `json:"print_duration"`
+	TotalDuration float64 `json:"total_duration"`
+	FilamentUsed  float64 `json:"filament_used"`
+	// klipper's reason for an error or cancel
+	Message string `json:"message,omitempty"`
+}
+
+type PrinterEvent struct {
+	Id            string        `json:"id"`
+	Type          string        `json:"event"`
+	Time          int64         `json:"time"`
+	Printer       EventPrinter  `json:"printer"`
+	PreviousState string        `json:"previous_state"`
+	State         string        `json:"state"`
+	Job           *EventJob     `json:"job,omitempty"`
+	Alert         *PrinterAlert `json:"alert,omitempty"`
+}
+
+type printerEventState struct {
+	state string
+	// job of the latest print, for prints that end after print_stats was lost
+	job *EventJob
+}
+
+var (
+	// last state other than offline per printer, so a print that ended while the
+	// printer was unreachable is still reported once it's back
+	EventStates     = make(map[string]printerEventState)
+	EventStatesLock sync.Mutex
+
+	events = make(chan PrinterEvent, 256)
+)
+
+func newEventId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newPrinterEvent(eventType string, previousState string, p PrinterInfoStatsPair) PrinterEvent {
+	return PrinterEvent{
+		Id:   newEventId(),
+		Type: eventType,
+		Time: time.Now().Unix(),
+		Printer: EventPrinter{
+			Id:   p.PrinterId,
+			Name: p.PrinterInfo.Name,
+		},
+		PreviousState: previousState,
+		State:         p.Stats.State,
+		Job:           eventJob(p),
+	}
+}
+
+func eventJob(p PrinterInfoStatsPair) *EventJob {
+	if p.Stats.Filename == "" {
+		return nil
+	}
+	return &EventJob{
+		Filename:      p.Stats.Filename,
+		Progress:      p.SDCard.Progress,
+		PrintDuration: p.Stats.PrintDuration,
+		TotalDuration: p.Stats.TotalDuration,
+		FilamentUsed:  p.Stats.Filamentused,
+		Message:       p.Stats.Message,
+	}
+}
+
+func newAlertEvent(alert PrinterAlert, p PrinterInfoStatsPair) PrinterEvent {
+	e := newPrinterEvent(EventAlert, p.Stats.State, p)
+	e.Alert = &alert
+	return e
+}
+
+// a print that stopped without going through complete, cancelled or error, e.g.
+// an mcu shutdown or a host that rebooted while it was offline
+func newInterruptedEvent(last printerEventState, p PrinterInfoStatsPair) PrinterEvent {
+	e := newPrinterEvent(EventPrintError, last.state, p)
+	if e.Job == nil && last.job != nil {
+		job := *last.job
+		e.Job = &job
+	}
+	if e.State == "" {
+		e.State = p.KlippyState
+	}
+
+	message := "print stopped without completing"
+	if klippyNotReady(p) {
+		message = "Klipper " + p.KlippyState
+		if p.StateMessage != "" {
+			message += ": " + p.StateMessage
+		}
+	}
+	if e.Job != nil && e.Job.Message == "" {
+		e.Job.Message = message
+	}
+	return e
+}
+
+// compares the printer's previous and new state. the first state seen for a
+// printer only sets the baseline, restarting guppyflo shouldn't fire events.
+func detectPrinterEvents(prev PrinterInfoStatsPair, next PrinterInfoStatsPair) []PrinterEvent {
+	EventStatesLock.Lock()
+	defer EventStatesLock.Unlock()
+
+	last, seen := EventStates[next.PrinterId]
+	lastState := last.state
+	state := next.Stats.State
+	found := make([]PrinterEvent, 0)
+
+	if state == "offline" {
+		if seen && prev.Stats.State != "offline" {
+			found = append(found, newPrinterEvent(EventOffline, prev.Stats.State, next))
+		}
+		return found
+	}
+
+	if seen && prev.Stats.State == "offline" {
+		found = append(found, newPrinterEvent(EventOnline, prev.Stats.State, next))
+	}
+
+	printing := lastState == "printing" || lastState == "paused"
+	if state == "" {
+		// klippy isn't ready and print_stats is gone with it, the last real state
+		// is kept so the print isn't reported twice once klippy is back
+		if printing && klippyNotReady(next) {
+			found = append(found, newInterruptedEvent(last, next))
+			EventStates[next.PrinterId] = printerEventState{state: "error", job: last.job}
+		}
+		return found
+	}
+
+	current := printerEventState{state: state, job: eventJob(next)}
+	if current.job == nil {
+		current.job = last.job
+	}
+	EventStates[next.PrinterId] = current
+	if !seen || state == lastState {
+		return found
+	}
+
+	switch {
+	case state == "printing":
+		// resuming isn't a new print
+		if lastState != "paused" {
+			found = append(found, newPrinterEvent(EventPrintStarted, lastState, next))
+		}
+	case state == "paused":
+		found = append(found, newPrinterEvent(EventPaused, lastState, next))
+	case state == "complete" && printing:
+		found = append(found, newPrinterEvent(EventPrintComplete, lastState, next))
+	case state == "cancelled" && printing:
+		found = append(found, newPrinterEvent(EventPrintCancelled, lastState, next))
+	case printing:
+		found = append(found, newInterruptedEvent(last, next))
+	}
+	return found
+}
+
+func deletePrinterEvents(printerId string) {
+	EventStatesLock.Lock()
+	defer EventStatesLock.Unlock()
+	delete(EventStates, printerId)
+}
+
+// queues events for delivery without ever blocking the printer data consumer
+func emitPrinterEvents(found []PrinterEvent) {
+	for _, e := range found {
+		select {
+		case events <- e:
+		default:
+			log.Println("Event queue full, dropping", e.Type, "for printer", e.Printer.Id)
+		}
+	}
+}
+
+func startEventDispatcher() {
+	go func() {
+		for e := range events {
+			log.Println("Printer event", e.Type, e.Printer.Id, e.Printer.Name)
+			deliverWebhooks(e)
+			deliverNotifications(e)
+		}
+	}()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+type eventStep struct {
+	state       string
+	filename    string
+	message     string
+	klippyState string
+	want        []string
+}
+
+func eventTestPair(s eventStep) PrinterInfoStatsPair {
+	return PrinterInfoStatsPair{
+		PrinterId:   "p1",
+		PrinterInfo: GTPrinterConfig{Name: "Voron"},
+		Stats:       PrinterStats{State: s.state, Filename: s.filename, Message: s.message},
+		KlippyState: s.klippyState,
+	}
+}
+
+func TestDetectPrinterEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []eventStep
+	}{
+		{
+			name: "first state is only the baseline",
+			steps: []eventStep{
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+			},
+		},
+		{
+			name: "print started and completed",
+			steps: []eventStep{
+				{state: "standby", klippyState: "ready"},
+				{state: "printing", filename: "a.gcode", klippyState: "ready", want: []string{EventPrintStarted}},
+				{state: "complete", filename: "a.gcode", klippyState: "ready", want: []string{EventPrintComplete}},
+				{state: "standby", klippyState: "ready"},
+			},
+		},
+		{
+			name: "resume isn't a new print",
+			steps: []eventStep{
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+				{state: "paused", filename: "a.gcode", klippyState: "ready", want: []string{EventPaused}},
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+				{state: "cancelled", filename: "a.gcode", klippyState: "ready", want: []string{EventPrintCancelled}},
+			},
+		},
+		{
+			name: "klipper error while printing",
+			steps: []eventStep{
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+				{state: "error", filename: "a.gcode", message: "Heater extruder not heating at expected rate", klippyState: "ready", want: []string{EventPrintError}},
+			},
+		},
+		{
+			name: "complete without a print isn't reported",
+			steps: []eventStep{
+				{state: "standby", klippyState: "ready"},
+				{state: "complete", filename: "a.gcode", klippyState: "ready"},
+			},
+		},
+		{
+			name: "klippy shutdown mid print is reported once",
+			steps: []eventStep{
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+				{klippyState: "shutdown", want: []string{EventPrintError}},
+				{klippyState: "shutdown"},
+				{state: "standby", klippyState: "ready"},
+			},
+		},
+		{
+			name: "host rebooted mid print",
+			steps: []eventStep{
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+				{state: "offline", want: []string{EventOffline}},
+				{state: "offline"},
+				{state: "standby", klippyState: "ready", want: []string{EventOnline, EventPrintError}},
+			},
+		},
+		{
+			name: "moonraker restart keeps the print going",
+			steps: []eventStep{
+				{state: "printing", filename: "a.gcode", klippyState: "ready"},
+				{state: "offline", want: []string{EventOffline}},
+				{state: "printing", filename: "a.gcode", klippyState: "ready", want: []string{EventOnline}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deletePrinterEvents("p1")
+			t.Cleanup(func() { deletePrinterEvents("p1") })
+
+			prev := PrinterInfoStatsPair{PrinterId: "p1"}
+			for i, s := range tt.steps {
+				next := eventTestPair(s)
+				got := make([]string, 0)
+				for _, e := range detectPrinterEvents(prev, next) {
+					got = append(got, e.Type)
+				}
+				want := s.want
+				if want == nil {
+					want = []string{}
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("step %d (%s): events = %v, want %v", i, s.state, got, want)
+				}
+				prev = next
+			}
+		})
+	}
+}
+
+func TestNewInterruptedEvent(t *testing.T) {
+	lastJob := &EventJob{Filename: "a.gcode", Progress: 0.4}
+	last := printerEventState{state: "printing", job: lastJob}
+
+	tests := []struct {
+		name        string
+		next        PrinterInfoStatsPair
+		wantState   string
+		wantJob     string
+		wantMessage string
+	}{
+		{
+			name:        "klippy shutdown keeps the last job",
+			next:        PrinterInfoStatsPair{KlippyState: "shutdown", StateMessage: "MCU 'mcu' shutdown: Timer too close"},
+			wantState:   "shutdown",
+			wantJob:     "a.gcode",
+			wantMessage: "Klipper shutdown: MCU 'mcu' shutdown: Timer too close",
+		},
+		{
+			name:        "klippy error without a message",
+			next:        PrinterInfoStatsPair{KlippyState: "error"},
+			wantState:   "error",
+			wantJob:     "a.gcode",
+			wantMessage: "Klipper error",
+		},
+		{
+			name:        "back in standby after a reboot",
+			next:        PrinterInfoStatsPair{KlippyState: "ready", Stats: PrinterStats{State: "standby"}},
+			wantState:   "standby",
+			wantJob:     "a.gcode",
+			wantMessage: "print stopped without completing",
+		},
+		{
+			name:        "klipper's own message wins",
+			next:        PrinterInfoStatsPair{KlippyState: "ready", Stats: PrinterStats{State: "error", Filename: "b.gcode", Message: "Move out of range"}},
+			wantState:   "error",
+			wantJob:     "b.gcode",
+			wantMessage: "Move out of range",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newInterruptedEvent(last, tt.next)
+			if e.Type != EventPrintError || e.PreviousState != "printing" {
+				t.Errorf("event = %s from %s, want %s from printing", e.Type, e.PreviousState, EventPrintError)
+			}
+			if e.State != tt.wantState {
+				t.Errorf("state = %q, want %q", e.State, tt.wantState)
+			}
+			if e.Job == nil {
+				t.Fatal("event has no job")
+			}
+			if e.Job.Filename != tt.wantJob || e.Job.Message != tt.wantMessage {
+				t.Errorf("job = %s %q, want %s %q", e.Job.Filename, e.Job.Message, tt.wantJob, tt.wantMessage)
+			}
+		})
+	}
+
+	// the stored job is shared with EventStates and must not pick up the message
+	if lastJob.Message != "" {
+		t.Errorf("last job was modified: %+v", lastJob)
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	body := []byte(`{"event":"print_complete"}`)
+	mac := hmac.New(sha256.New, []byte("changeme"))
+	mac.Write([]byte("1718000000." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := signPayload("changeme", "1718000000", body); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+	// a replay with a new timestamp needs a new signature
+	if signPayload("changeme", "1718000300", body) == want {
+		t.Error("signature doesn't cover the timestamp")
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFileIndexInterval = 10 * time.Minute
+	// how often the indexer looks for printers due for a refresh, e.g. ones that just came online
+	fileIndexCheckInterval = time.Minute
+	fileCopyTimeout        = 30 * time.Minute
+)
+
+type IndexedFile struct {
+	PrinterId   string  `json:"printer_id"`
+	PrinterName string  `json:"printer_name,omitempty"`
+	Root        string  `json:"root"`
+	Path        string  `json:"path"`
+	Size        int64   `json:"size"`
+	Modified    float64 `json:"modified"`
+}
+
+type PrinterFileIndex struct {
+	Refreshed int64  `json:"refreshed,omitempty"`
+	Error     string `json:"error,omitempty"`
+	files     []IndexedFile
+}
+
+var (
+	// last known files per printer, kept while a printer is unreachable
+	FileIndex     = make(map[string]*PrinterFileIndex)
+	FileIndexLock sync.RWMutex
+)
+
+func fileIndexRoots() []string {
+	GTConfigLock.RLock()
+	defer GTConfigLock.RUnlock()
+	if c := gtconfig.FileIndex; c != nil && c.IncludeConfig {
+		return []string{"gcodes", "config"}
+	}
+	return []string{"gcodes"}
+}
+
+func fileIndexInterval() time.Duration {
+	GTConfigLock.RLock()
+	defer GTConfigLock.RUnlock()
+	if c := gtconfig.FileIndex; c != nil && c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Second
+	}
+	return defaultFileIndexInterval
+}
+
+func fetchPrinterFiles(p PrinterInfoStatsPair, roots []string) ([]IndexedFile, error) {
+	files := make([]IndexedFile, 0)
+	for _, root := range roots {
+		var result []struct {
+			Path     string  `json:"path"`
+			Size     int64   `json:"size"`
+			Modified float64 `json:"modified"`
+		}
+		if err := moonrakerGetResult(p.PrinterInfo, "/server/files/list?root="+url.QueryEscape(root), &result); err != nil {
+			return nil, err
+		}
+		for _, f := range result {
+			files = append(files, IndexedFile{
+				PrinterId:   p.PrinterId,
+				PrinterName: p.PrinterInfo.Name,
+				Root:        root,
+				Path:        f.Path,
+				Size:        f.Size,
+				Modified:    f.Modified,
+			})
+		}
+	}
+	return files, nil
+}
+
+func refreshPrinterFiles(p PrinterInfoStatsPair, roots []string) {
+	files, err := fetchPrinterFiles(p, roots)
+
+	FileIndexLock.Lock()
+	defer FileIndexLock.Unlock()
+	index, exists := FileIndex[p.PrinterId]
+	if !exists {
+		index = &PrinterFileIndex{files: make([]IndexedFile, 0)}
+		FileIndex[p.PrinterId] = index
+	}
+	if err != nil {
+		index.Error = err.Error()
+		return
+	}
+	index.files = files
+	index.Error = ""
+	index.Refreshed = time.Now().Unix()
+}
+
+// refreshes the given printers, or all of them, at once. offline printers keep their last known files.
+func refreshFileIndex(printerIds []string) {
+	PrintersMapLock.RLock()
+	printers := getSortedPrinters()
+	PrintersMapLock.RUnlock()
+
+	roots := fileIndexRoots()
+	var wg sync.WaitGroup
+	for _, p := range printers {
+		if len(printerIds) > 0 && !slices.Contains(printerIds, p.PrinterId) {
+			continue
+		}
+		if p.Stats.State == "offline" {
+			FileIndexLock.Lock()
+			if index, exists := FileIndex[p.PrinterId]; exists {
+				index.Error = "printer is offline"
+			}
+			FileIndexLock.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(p PrinterInfoStatsPair) {
+			defer wg.Done()
+			refreshPrinterFiles(p, roots)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func deletePrinterFiles(printerId string) {
+	FileIndexLock.Lock()
+	defer FileIndexLock.Unlock()
+	delete(FileIndex, printerId)
+}
+
+// printers online but never indexed or not refreshed for the index interval
+func staleFileIndexPrinters() []string {
+	PrintersMapLock.RLock()
+	printers := getSortedPrinters()
+	PrintersMapLock.RUnlock()
+
+	interval := fileIndexInterval()
+	FileIndexLock.RLock()
+	defer FileIndexLock.RUnlock()
+	stale := make([]string, 0)
+	for _, p := range printers {
+		if p.Stats.State == "offline" {
+			continue
+		}
+		index, exists := FileIndex[p.PrinterId]
+		if !exists || time.Since(time.Unix(index.Refreshed, 0)) >= interval {
+			stale = append(stale, p.PrinterId)
+		}
+	}
+	return stale
+}
+
+func startFileIndexer() {
+	go func() {
+		for range time.Tick(fileIndexCheckInterval) {
+			if stale := staleFileIndexPrinters(); len(stale) > 0 {
+				refreshFileIndex(stale)
+			}
+		}
+	}()
+}
+
+func writeFileIndex(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search := strings.ToLower(query.Get("q"))
+	root := query.Get("root")
+	printerIds := parseListParam(r, "printer")
+
+	FileIndexLock.RLock()
+	files := make([]IndexedFile, 0)
+	status := make(map[string]PrinterFileIndex)
+	for printerId, index := range FileIndex {
+		if len(printerIds) > 0 && !slices.Contains(printerIds, printerId) {
+			continue
+		}
+		status[printerId] = PrinterFileIndex{Refreshed: index.Refreshed, Error: index.Error}
+		for _, f := range index.files {
+			if root != "" && f.Root != root {
+				continue
+			}
+			if search != "" && !strings.Contains(strings.ToLower(f.Path), search) {
+				continue
+			}
+			files = append(files, f)
+		}
+	}
+	FileIndexLock.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Path != files[j].Path {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].PrinterName < files[j].PrinterName
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"files":    files,
+		"printers": status,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GET searches the index with q (part of the path), root and printer,
+// POST refreshes it first, for the given printers or all of them
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeFileIndex(w, r)
+	case "POST":
+		refreshFileIndex(parseListParam(r, "printer"))
+		writeFileIndex(w, r)
+	default:
+		http.Error(w, "405 unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func fileRequestPrinter(w http.ResponseWriter, r *http.Request) (PrinterInfoStatsPair, bool) {
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	printer, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+	}
+	return printer, exists
+}
+
+// root and path of the file a request is about, paths can't climb out of their root
+func fileRequestPath(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	root := r.URL.Query().Get("root")
+	if root == "" {
+		root = "gcodes"
+	}
+	if root != "gcodes" && root != "config" {
+		http.Error(w, "root must be gcodes or config", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" || path.Clean("/"+filePath) != "/"+filePath {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return "", "", false
+	}
+	return root, filePath, true
+}
+
+func fileMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	printer, exists := fileRequestPrinter(w, r)
+	if !exists {
+		return
+	}
+	root, filePath, ok := fileRequestPath(w, r)
+	if !ok {
+		return
+	}
+	if root != "gcodes" {
+		http.Error(w, "metadata is only available for gcodes", http.StatusBadRequest)
+		return
+	}
+
+	var metadata json.RawMessage
+	if err := moonrakerGetResult(printer.PrinterInfo, "/server/files/metadata?filename="+url.QueryEscape(filePath), &metadata); err != nil {
+		http.Error(w, "Failed to get metadata: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(metadata)
+}
+
+func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	printer, exists := fileRequestPrinter(w, r)
+	if !exists {
+		return
+	}
+	root, filePath, ok := fileRequestPath(w, r)
+	if !ok {
+		return
+	}
+
+	filesPath := "/server/files/" + root + "/" + escapeFilePath(filePath)
+	resp, err := moonrakerRequest(printer.PrinterInfo, http.MethodDelete, filesPath, nil, "")
+	if err != nil {
+		http.Error(w, "Failed to delete file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, fmt.Sprintf("Failed to delete file: %s", resp.Status), http.StatusBadGateway)
+		return
+	}
+
+	FileIndexLock.Lock()
+	if index, exists := FileIndex[printer.PrinterId]; exists {
+		index.files = slices.DeleteFunc(index.files, func(f IndexedFile) bool {
+			return f.Root == root && f.Path == filePath
+		})
+	}
+	FileIndexLock.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// downloads the file once and uploads it to every target printer under the same path
+func copyFileHandler(w http.ResponseWriter, r *http.Request) {
+	printer, exists := fileRequestPrinter(w, r)
+	if !exists {
+		return
+	}
+	root, filePath, ok := fileRequestPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		To []string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.To) == 0 {
+		http.Error(w, "to needs at least one printer id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fileCopyTimeout)
+	defer cancel()
+
+	tmpFile, err := os.CreateTemp("", "guppyflo-copy-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	filesPath := "/server/files/" + root + "/" + escapeFilePath(filePath)
+	resp, err := moonrakerTransfer(ctx, printer.PrinterInfo, http.MethodGet, filesPath, nil, 0, "")
+	if err != nil {
+		http.Error(w, "Failed to download file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "Failed to download file: "+resp.Status, http.StatusBadGateway)
+		return
+	}
+	size, err := io.Copy(tmpFile, resp.Body)
+	if err != nil {
+		http.Error(w, "Failed to download file: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	results := make([]ActionResult, len(req.To))
+	for i, printerId := range req.To {
+		results[i] = ActionResult{PrinterId: printerId, Action: "copy"}
+
+		PrintersMapLock.RLock()
+		target, exists := Printers[printerId]
+		PrintersMapLock.RUnlock()
+		if !exists {
+			results[i].Error = "printer not found"
+			continue
+		}
+		results[i].Name = target.PrinterInfo.Name
+
+		content := io.NewSectionReader(tmpFile, 0, size)
+		if _, err := moonrakerUploadFile(ctx, target.PrinterInfo, root, filePath, content, size, false); err != nil {
+			log.Println("Failed to copy", filePath, "to printer", printerId, err)
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Ok = true
+	}
+
+	okTargets := make([]string, 0)
+	for _, result := range results {
+		if result.Ok {
+			okTargets = append(okTargets, result.PrinterId)
+		}
+	}
+	if len(okTargets) > 0 {
+		refreshFileIndex(okTargets)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]any{
+		"root":    root,
+		"path":    filePath,
+		"results": results,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
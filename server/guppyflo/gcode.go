@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGcodeTimeout = 60
+	maxGcodeTimeout     = 600
+)
+
+type GcodeRequest struct {
+	Script   string   `json:"script"`
+	Printers []string `json:"printers,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+	// seconds to wait for klipper to finish the script, e.g. homing takes a while
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type GcodeResult struct {
+	PrinterId string `json:"printer_id"`
+	Name      string `json:"printer_name,omitempty"`
+	Ok        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	// console lines klipper sent while the script ran
+	Output []string `json:"output"`
+}
+
+// runs the script over a fresh websocket so the console output that comes back
+// as notify_gcode_response can be collected next to the result
+func runGcodeScript(ctx context.Context, p GTPrinterConfig, script string) ([]string, error) {
+	socket, err := connectMoonrakerSocket(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]string, 0)
+	collected := make(chan bool)
+	go func() {
+		defer close(collected)
+		for n := range socket.Notifications {
+			if n.Method != "notify_gcode_response" {
+				continue
+			}
+			var lines []string
+			if err := json.Unmarshal(n.Params, &lines); err == nil {
+				output = append(output, lines...)
+			}
+		}
+	}()
+
+	err = socket.Call(ctx, "printer.gcode.script", map[string]string{"script": script}, nil)
+	// responses arrive before the result, closing lets the collector drain them and stop
+	socket.Close()
+	<-collected
+	return output, err
+}
+
+// runs on every target at once. the script is built per printer, e.g. to check it has the macro
+func runGcodeOnPrinters(ctx context.Context, targets []string, script func(p PrinterInfoStatsPair) (string, error)) []GcodeResult {
+	results := make([]GcodeResult, len(targets))
+	var wg sync.WaitGroup
+	for i, printerId := range targets {
+		results[i] = GcodeResult{PrinterId: printerId, Output: make([]string, 0)}
+
+		PrintersMapLock.RLock()
+		printer, exists := Printers[printerId]
+		PrintersMapLock.RUnlock()
+		if !exists {
+			results[i].Error = "printer not found"
+			continue
+		}
+		results[i].Name = printer.PrinterInfo.Name
+
+		wg.Add(1)
+		go func(result *GcodeResult, p PrinterInfoStatsPair) {
+			defer wg.Done()
+			s, err := script(p)
+			if err == nil {
+				var output []string
+				output, err = runGcodeScript(ctx, p.PrinterInfo, s)
+				result.Output = append(result.Output, output...)
+			}
+			if err != nil {
+				log.Println("G-code script failed for printer", result.PrinterId, err)
+				result.Error = err.Error()
+				return
+			}
+			result.Ok = true
+		}(&results[i], printer)
+	}
+	wg.Wait()
+	return results
+}
+
+func gcodeTimeout(w http.ResponseWriter, seconds int) (time.Duration, bool) {
+	if seconds < 0 || seconds > maxGcodeTimeout {
+		http.Error(w, "timeout must be between 1 and 600 seconds", http.StatusBadRequest)
+		return 0, false
+	}
+	if seconds == 0 {
+		seconds = defaultGcodeTimeout
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func gcodeHandler(w http.ResponseWriter, r *http.Request) {
+	var req GcodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode gcode json", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Script) == "" {
+		http.Error(w, "script is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Printers) == 0 && req.Tag == "" {
+		http.Error(w, "Either printers or tag is required", http.StatusBadRequest)
+		return
+	}
+	timeout, ok := gcodeTimeout(w, req.Timeout)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	targets := actionTargets(ActionRequest{Printers: req.Printers, Tag: req.Tag})
+	results := runGcodeOnPrinters(ctx, targets, func(p PrinterInfoStatsPair) (string, error) {
+		return req.Script, nil
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"script":  req.Script,
+		"results": results,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobHistorySyncInterval = 10 * time.Minute
+	jobHistoryPageSize     = 50
+)
+
+type PrintJob struct {
+	PrinterId     string  `json:"printer_id"`
+	PrinterName   string  `json:"printer_name,omitempty"`
+	JobId         string  `json:"job_id"`
+	Filename      string  `json:"filename"`
+	Status        string  `json:"status"`
+	StartTime     float64 `json:"start_time"`
+	EndTime       float64 `json:"end_time"`
+	PrintDuration float64 `json:"print_duration"`
+	TotalDuration float64 `json:"total_duration"`
+	FilamentUsed  float64 `json:"filament_used"`
+}
+
+type PrintJobTotals struct {
+	Count         int     `json:"count"`
+	PrintDuration float64 `json:"print_duration"`
+	TotalDuration float64 `json:"total_duration"`
+	FilamentUsed  float64 `json:"filament_used"`
+}
+
+var (
+	// keyed by printer id then moonraker job id
+	JobHistory     = make(map[string]map[string]PrintJob)
+	JobHistoryLock sync.RWMutex
+)
+
+func jobHistoryFile() string {
+	return filepath.Join(filepath.Dir(configPath), "print_history.json")
+}
+
+func loadJobHistory() {
+	content, err := os.ReadFile(jobHistoryFile())
+	if err != nil {
+		return
+	}
+
+	var jobs []PrintJob
+	if err := json.Unmarshal(content, &jobs); err != nil {
+		log.Println("Failed to load print history", err)
+		return
+	}
+
+	JobHistoryLock.Lock()
+	defer JobHistoryLock.Unlock()
+	for _, j := range jobs {
+		if _, exists := JobHistory[j.PrinterId]; !exists {
+			JobHistory[j.PrinterId] = make(map[string]PrintJob)
+		}
+		JobHistory[j.PrinterId][j.JobId] = j
+	}
+}
+
+// callers must hold JobHistoryLock
+func saveJobHistory() {
+	jobs := make([]PrintJob, 0)
+	for _, printerJobs := range JobHistory {
+		for _, j := range printerJobs {
+			jobs = append(jobs, j)
+		}
+	}
+
+	content, err := json.Marshal(jobs)
+	if err != nil {
+		log.Println("Failed to encode print history", err)
+		return
+	}
+
+	tmpFile := jobHistoryFile() + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		log.Println("Failed to save print history", err)
+		return
+	}
+	if err := os.Rename(tmpFile, jobHistoryFile()); err != nil {
+		log.Println("Failed to save print history", err)
+	}
+}
+
+// moonraker filters by start time, so resume from the oldest job that may
+// still change (in progress) or else the newest one already stored
+func jobHistorySince(printerId string) float64 {
+	JobHistoryLock.RLock()
+	defer JobHistoryLock.RUnlock()
+
+	var newest float64
+	oldestInProgress := -1.0
+	for _, j := range JobHistory[printerId] {
+		newest = max(newest, j.StartTime)
+		if j.Status == "in_progress" && (oldestInProgress < 0 || j.StartTime < oldestInProgress) {
+			oldestInProgress = j.StartTime
+		}
+	}
+
+	if oldestInProgress >= 0 {
+		return oldestInProgress
+	}
+	return newest
+}
+
+func fetchJobHistory(p GTPrinterConfig, since float64) ([]PrintJob, error) {
+	jobs := make([]PrintJob, 0)
+	for start := 0; ; start += jobHistoryPageSize {
+		historyPath := fmt.Sprintf("/server/history/list?order=asc&limit=%d&start=%d", jobHistoryPageSize, start)
+		if since > 0 {
+			// overlap by a second, jobs are upserted by id anyway
+			historyPath += fmt.Sprintf("&since=%f", since-1)
+		}
+
+		var result struct {
+			Count int        `json:"count"`
+			Jobs  []PrintJob `json:"jobs"`
+		}
+		if err := moonrakerGetResult(p, historyPath, &result); err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, result.Jobs...)
+		if len(result.Jobs) < jobHistoryPageSize {
+			return jobs, nil
+		}
+	}
+}
+
+func syncJobHistory() {
+	PrintersMapLock.RLock()
+	printers := getSortedPrinters()
+	PrintersMapLock.RUnlock()
+
+	updated := false
+	for _, p := range printers {
+		jobs, err := fetchJobHistory(p.PrinterInfo, jobHistorySince(p.PrinterId))
+		if err != nil {
+			log.Println("Failed to sync print history for printer", p.PrinterId, err)
+			continue
+		}
+
+		JobHistoryLock.Lock()
+		if _, exists := JobHistory[p.PrinterId]; !exists {
+			JobHistory[p.PrinterId] = make(map[string]PrintJob)
+		}
+		for _, j := range jobs {
+			j.PrinterId = p.PrinterId
+			JobHistory[p.PrinterId][j.JobId] = j
+			updated = true
+		}
+		JobHistoryLock.Unlock()
+	}
+
+	if updated {
+		JobHistoryLock.Lock()
+		saveJobHistory()
+		JobHistoryLock.Unlock()
+	}
+}
+
+func deleteJobHistory(printerId string) {
+	JobHistoryLock.Lock()
+	defer JobHistoryLock.Unlock()
+	if _, exists := JobHistory[printerId]; exists {
+		delete(JobHistory, printerId)
+		saveJobHistory()
+	}
+}
+
+func startJobHistorySync() {
+	loadJobHistory()
+	go func() {
+		syncJobHistory()
+		for range time.Tick(jobHistorySyncInterval) {
+			syncJobHistory()
+		}
+	}()
+}
+
+func jobHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	printerIds := parseListParam(r, "printer")
+	statuses := parseListParam(r, "status")
+	filename := strings.ToLower(query.Get("filename"))
+
+	from, err := parseUnixParam(r, "from", 0)
+	if err != nil {
+		http.Error(w, "bad from timestamp", http.StatusBadRequest)
+		return
+	}
+	to, err := parseUnixParam(r, "to", 0)
+	if err != nil {
+		http.Error(w, "bad to timestamp", http.StatusBadRequest)
+		return
+	}
+
+	PrintersMapLock.RLock()
+	names := make(map[string]string)
+	for id, p := range Printers {
+		names[id] = p.PrinterInfo.Name
+	}
+	PrintersMapLock.RUnlock()
+
+	jobs := make([]PrintJob, 0)
+	var totals PrintJobTotals
+
+	JobHistoryLock.RLock()
+	for printerId, printerJobs := range JobHistory {
+		if len(printerIds) > 0 && !slices.Contains(printerIds, printerId) {
+			continue
+		}
+
+		for _, j := range printerJobs {
+			if len(statuses) > 0 && !slices.Contains(statuses, j.Status) {
+				continue
+			}
+			if from > 0 && j.StartTime < float64(from) {
+				continue
+			}
+			if to > 0 && j.StartTime > float64(to) {
+				continue
+			}
+			if filename != "" && !strings.Contains(strings.ToLower(j.Filename), filename) {
+				continue
+			}
+
+			j.PrinterName = names[printerId]
+			jobs = append(jobs, j)
+			totals.Count++
+			totals.PrintDuration += j.PrintDuration
+			totals.TotalDuration += j.TotalDuration
+			totals.FilamentUsed += j.FilamentUsed
+		}
+	}
+	JobHistoryLock.RUnlock()
+
+	sort.SliceStable(jobs, func(a, b int) bool {
+		return jobs[a].StartTime > jobs[b].StartTime
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]any{
+		"jobs":   jobs,
+		"totals": totals,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
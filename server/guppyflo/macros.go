@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// klipper config rarely changes, macros are refetched after this or on ?refresh=true
+const macroCacheDuration = 5 * time.Minute
+
+var (
+	// params.TEMP, params["TEMP"] or params['TEMP'], optionally followed by |default(...)
+	macroParamPattern = regexp.MustCompile(`params(?:\.([A-Za-z_][A-Za-z0-9_]*)|\[\s*['"]([^'"]+)['"]\s*\])(?:\s*\|\s*default\(\s*([^)]*?)\s*\))?`)
+	macroParamName    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+type MacroParam struct {
+	Name    string `json:"name"`
+	Default string `json:"default,omitempty"`
+}
+
+type PrinterMacro struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Params      []MacroParam `json:"params"`
+}
+
+type FleetMacro struct {
+	PrinterMacro
+	Printers []string `json:"printers"`
+}
+
+type macroCache struct {
+	fetched time.Time
+	macros  []PrinterMacro
+}
+
+var (
+	MacroCaches     = make(map[string]macroCache)
+	MacroCachesLock sync.Mutex
+)
+
+// parameters in the order the macro first uses them
+func parseMacroParams(gcode string) []MacroParam {
+	params := make([]MacroParam, 0)
+	for _, m := range macroParamPattern.FindAllStringSubmatch(gcode, -1) {
+		name := strings.ToUpper(m[1] + m[2])
+		idx := slices.IndexFunc(params, func(p MacroParam) bool {
+			return p.Name == name
+		})
+		if idx < 0 {
+			params = append(params, MacroParam{Name: name})
+			idx = len(params) - 1
+		}
+		if params[idx].Default == "" {
+			params[idx].Default = strings.Trim(m[3], `'"`)
+		}
+	}
+	return params
+}
+
+func fetchPrinterMacros(p GTPrinterConfig) ([]PrinterMacro, error) {
+	var list struct {
+		Objects []string `json:"objects"`
+	}
+	if err := moonrakerGetResult(p, "/printer/objects/list", &list); err != nil {
+		return nil, err
+	}
+
+	var query struct {
+		Status struct {
+			ConfigFile struct {
+				Settings map[string]map[string]any `json:"settings"`
+			} `json:"configfile"`
+		} `json:"status"`
+	}
+	if err := moonrakerGetResult(p, "/printer/objects/query?configfile=settings", &query); err != nil {
+		return nil, err
+	}
+
+	macros := make([]PrinterMacro, 0)
+	for _, o := range list.Objects {
+		name, found := strings.CutPrefix(o, "gcode_macro ")
+		if !found {
+			continue
+		}
+
+		macro := PrinterMacro{Name: strings.ToUpper(name), Params: make([]MacroParam, 0)}
+		// configfile keys are lower case
+		if settings, exists := query.Status.ConfigFile.Settings[strings.ToLower(o)]; exists {
+			if description, ok := settings["description"].(string); ok {
+				macro.Description = description
+			}
+			if gcode, ok := settings["gcode"].(string); ok {
+				macro.Params = parseMacroParams(gcode)
+			}
+		}
+		macros = append(macros, macro)
+	}
+
+	sort.Slice(macros, func(i, j int) bool {
+		return macros[i].Name < macros[j].Name
+	})
+	return macros, nil
+}
+
+func getPrinterMacros(p PrinterInfoStatsPair, refresh bool) ([]PrinterMacro, error) {
+	MacroCachesLock.Lock()
+	cached, exists := MacroCaches[p.PrinterId]
+	MacroCachesLock.Unlock()
+	if exists && !refresh && time.Since(cached.fetched) < macroCacheDuration {
+		return cached.macros, nil
+	}
+
+	macros, err := fetchPrinterMacros(p.PrinterInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	MacroCachesLock.Lock()
+	MacroCaches[p.PrinterId] = macroCache{fetched: time.Now(), macros: macros}
+	MacroCachesLock.Unlock()
+	return macros, nil
+}
+
+func deletePrinterMacros(printerId string) {
+	MacroCachesLock.Lock()
+	defer MacroCachesLock.Unlock()
+	delete(MacroCaches, printerId)
+}
+
+// macros starting with an underscore are helpers that aren't meant to be run by hand
+func visibleMacros(macros []PrinterMacro, all bool) []PrinterMacro {
+	if all {
+		return macros
+	}
+	return slices.DeleteFunc(slices.Clone(macros), func(m PrinterMacro) bool {
+		return strings.HasPrefix(m.Name, "_")
+	})
+}
+
+// NAME KEY=VALUE ..., only for macros the printer actually has
+func buildMacroScript(macros []PrinterMacro, name string, params map[string]string) (string, error) {
+	name = strings.ToUpper(name)
+	idx := slices.IndexFunc(macros, func(m PrinterMacro) bool {
+		return m.Name == name
+	})
+	if idx < 0 {
+		return "", fmt.Errorf("macro %s not found", name)
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	script := name
+	for _, k := range keys {
+		v := params[k]
+		if !macroParamName.MatchString(k) {
+			return "", fmt.Errorf("invalid parameter name %q", k)
+		}
+		// klipper cuts the line at a comment character, even inside quotes
+		if strings.ContainsAny(v, "\"\r\n;#*") {
+			return "", fmt.Errorf("invalid value for %s", k)
+		}
+		if strings.ContainsAny(v, " \t") {
+			v = `"` + v + `"`
+		}
+		script += " " + strings.ToUpper(k) + "=" + v
+	}
+	return script, nil
+}
+
+func printerMacrosHandler(w http.ResponseWriter, r *http.Request) {
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	printer, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+
+	macros, err := getPrinterMacros(printer, r.URL.Query().Get("refresh") == "true")
+	if err != nil {
+		http.Error(w, "Failed to list macros: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(visibleMacros(macros, r.URL.Query().Get("all") == "true"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// every printer's macros grouped by name, printers that couldn't be asked are listed with their error
+func fleetMacrosHandler(w http.ResponseWriter, r *http.Request) {
+	refresh := r.URL.Query().Get("refresh") == "true"
+	all := r.URL.Query().Get("all") == "true"
+
+	PrintersMapLock.RLock()
+	printers := getSortedPrinters()
+	PrintersMapLock.RUnlock()
+
+	found := make([][]PrinterMacro, len(printers))
+	failures := make(map[string]string)
+	var failuresLock sync.Mutex
+	var wg sync.WaitGroup
+	for i, p := range printers {
+		if p.Stats.State == "offline" {
+			failuresLock.Lock()
+			failures[p.PrinterId] = "printer is offline"
+			failuresLock.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, p PrinterInfoStatsPair) {
+			defer wg.Done()
+			macros, err := getPrinterMacros(p, refresh)
+			if err != nil {
+				failuresLock.Lock()
+				failures[p.PrinterId] = err.Error()
+				failuresLock.Unlock()
+				return
+			}
+			found[i] = visibleMacros(macros, all)
+		}(i, p)
+	}
+	wg.Wait()
+
+	grouped := make([]FleetMacro, 0)
+	for i, macros := range found {
+		for _, m := range macros {
+			idx := slices.IndexFunc(grouped, func(g FleetMacro) bool {
+				return g.Name == m.Name
+			})
+			if idx < 0 {
+				grouped = append(grouped, FleetMacro{
+					PrinterMacro: PrinterMacro{Name: m.Name, Params: make([]MacroParam, 0)},
+					Printers:     make([]string, 0),
+				})
+				idx = len(grouped) - 1
+			}
+
+			g := &grouped[idx]
+			g.Printers = append(g.Printers, printers[i].PrinterId)
+			if g.Description == "" {
+				g.Description = m.Description
+			}
+			for _, param := range m.Params {
+				if !slices.ContainsFunc(g.Params, func(existing MacroParam) bool { return existing.Name == param.Name }) {
+					g.Params = append(g.Params, param)
+				}
+			}
+		}
+	}
+	sort.Slice(grouped, func(i, j int) bool {
+		return grouped[i].Name < grouped[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"macros": grouped,
+		"errors": failures,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type MacroRunRequest struct {
+	Params map[string]string `json:"params,omitempty"`
+	// fleet only
+	Printers []string `json:"printers,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+	Timeout  int      `json:"timeout,omitempty"`
+}
+
+func runMacro(w http.ResponseWriter, r *http.Request, req MacroRunRequest, targets []string) {
+	timeout, ok := gcodeTimeout(w, req.Timeout)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	name := strings.ToUpper(r.PathValue("name"))
+	results := runGcodeOnPrinters(ctx, targets, func(p PrinterInfoStatsPair) (string, error) {
+		macros, err := getPrinterMacros(p, false)
+		if err != nil {
+			return "", err
+		}
+		return buildMacroScript(macros, name, req.Params)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"macro":   name,
+		"results": results,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func runPrinterMacroHandler(w http.ResponseWriter, r *http.Request) {
+	var req MacroRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode macro json", http.StatusBadRequest)
+		return
+	}
+
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	_, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+	runMacro(w, r, req, []string{printerId})
+}
+
+func runFleetMacroHandler(w http.ResponseWriter, r *http.Request) {
+	var req MacroRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode macro json", http.StatusBadRequest)
+		return
+	}
+	if len(req.Printers) == 0 && req.Tag == "" {
+		http.Error(w, "Either printers or tag is required", http.StatusBadRequest)
+		return
+	}
+	runMacro(w, r, req, actionTargets(ActionRequest{Printers: req.Printers, Tag: req.Tag}))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMacroParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		gcode string
+		want  []MacroParam
+	}{
+		{
+			name:  "no params",
+			gcode: "G28\nG1 Z10",
+			want:  []MacroParam{},
+		},
+		{
+			name:  "attribute access",
+			gcode: "M104 S{params.TEMP}",
+			want:  []MacroParam{{Name: "TEMP"}},
+		},
+		{
+			name:  "index access with either quote",
+			gcode: `{% set a = params['BED'] %}{% set b = params["EXTRUDER"] %}`,
+			want:  []MacroParam{{Name: "BED"}, {Name: "EXTRUDER"}},
+		},
+		{
+			name:  "lower case names are upper cased",
+			gcode: "{params.speed}",
+			want:  []MacroParam{{Name: "SPEED"}},
+		},
+		{
+			name:  "defaults",
+			gcode: `{% set t = params.TEMP|default(200)|float %}{% set m = params['MATERIAL'] | default( "PLA" ) %}`,
+			want:  []MacroParam{{Name: "TEMP", Default: "200"}, {Name: "MATERIAL", Default: "PLA"}},
+		},
+		{
+			name:  "single quoted default",
+			gcode: `{params.SHEET|default('textured')}`,
+			want:  []MacroParam{{Name: "SHEET", Default: "textured"}},
+		},
+		{
+			name:  "duplicates keep first use order",
+			gcode: "{params.B} {params.A} {params['B']} {params.a}",
+			want:  []MacroParam{{Name: "B"}, {Name: "A"}},
+		},
+		{
+			name:  "default found on a later use",
+			gcode: "{% if params.TEMP %}M104 S{params.TEMP|default(210)}{% endif %}",
+			want:  []MacroParam{{Name: "TEMP", Default: "210"}},
+		},
+		{
+			name:  "first default wins",
+			gcode: "{params.TEMP|default(200)} {params.TEMP|default(250)}",
+			want:  []MacroParam{{Name: "TEMP", Default: "200"}},
+		},
+		{
+			name:  "rawparams isn't a parameter",
+			gcode: "RESPOND MSG={rawparams}",
+			want:  []MacroParam{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMacroParams(tt.gcode)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMacroParams(%q) = %+v, want %+v", tt.gcode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildMacroScript(t *testing.T) {
+	macros := []PrinterMacro{
+		{Name: "PRINT_START"},
+		{Name: "LOAD_FILAMENT"},
+	}
+
+	tests := []struct {
+		name    string
+		macro   string
+		params  map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "no params",
+			macro: "LOAD_FILAMENT",
+			want:  "LOAD_FILAMENT",
+		},
+		{
+			name:   "names are upper cased and params sorted",
+			macro:  "print_start",
+			params: map[string]string{"extruder": "210", "BED": "60"},
+			want:   "PRINT_START BED=60 EXTRUDER=210",
+		},
+		{
+			name:   "values with spaces are quoted",
+			macro:  "PRINT_START",
+			params: map[string]string{"MATERIAL": "PETG CF", "SHEET": "smooth\tpei"},
+			want:   "PRINT_START MATERIAL=\"PETG CF\" SHEET=\"smooth\tpei\"",
+		},
+		{
+			name:   "empty value",
+			macro:  "PRINT_START",
+			params: map[string]string{"MATERIAL": ""},
+			want:   "PRINT_START MATERIAL=",
+		},
+		{
+			name:    "unknown macro",
+			macro:   "FIRMWARE_RESTART",
+			wantErr: true,
+		},
+		{
+			name:    "newline starts another command",
+			macro:   "PRINT_START",
+			params:  map[string]string{"BED": "60\nFIRMWARE_RESTART"},
+			wantErr: true,
+		},
+		{
+			name:    "carriage return",
+			macro:   "PRINT_START",
+			params:  map[string]string{"BED": "60\rM112"},
+			wantErr: true,
+		},
+		{
+			name:    "semicolon comment",
+			macro:   "PRINT_START",
+			params:  map[string]string{"BED": "60;M112"},
+			wantErr: true,
+		},
+		{
+			name:    "hash comment",
+			macro:   "PRINT_START",
+			params:  map[string]string{"BED": "60 # comment"},
+			wantErr: true,
+		},
+		{
+			name:    "checksum marker",
+			macro:   "PRINT_START",
+			params:  map[string]string{"BED": "60*12"},
+			wantErr: true,
+		},
+		{
+			name:    "quote breaking out of the value",
+			macro:   "PRINT_START",
+			params:  map[string]string{"MATERIAL": `PLA" EXTRUDER="300`},
+			wantErr: true,
+		},
+		{
+			name:    "space in the parameter name",
+			macro:   "PRINT_START",
+			params:  map[string]string{"BED=60 EXTRUDER": "300"},
+			wantErr: true,
+		},
+		{
+			name:    "newline in the parameter name",
+			macro:   "PRINT_START",
+			params:  map[string]string{"BED\nM112": "60"},
+			wantErr: true,
+		},
+		{
+			name:    "parameter name starting with a digit",
+			macro:   "PRINT_START",
+			params:  map[string]string{"1BED": "60"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildMacroScript(macros, tt.macro, tt.params)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("buildMacroScript(%q, %q) = %q, want an error", tt.macro, tt.params, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("buildMacroScript(%q, %q) = %q, want %q", tt.macro, tt.params, got, tt.want)
+			}
+		})
+	}
+}
@@ -14,12 +14,14 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -61,6 +63,13 @@ type ExtruderStats struct {
 	Target      float64 `json:"target"`
 }
 
+type ToolStats struct {
+	Name        string  `json:"name"`
+	Temperature float64 `json:"temperature"`
+	Target      float64 `json:"target"`
+	Active      bool    `json:"active"`
+}
+
 type HeaterBedStats struct {
 	Temperature float64 `json:"temperature"`
 	Target      float64 `json:"target"`
@@ -80,16 +89,21 @@ type MoonrakerCameras struct {
 	} `json:"result"`
 }
 
+type WebhooksStatus struct {
+	State        string `json:"state"`
+	StateMessage string `json:"state_message"`
+}
+
+type MoonrakerPrinterStatus struct {
+	Stats     PrinterStats   `json:"print_stats"`
+	SDCard    VirtualSDCard  `json:"virtual_sdcard"`
+	Extruder  ExtruderStats  `json:"extruder,omitempty"`
+	HeaterBed HeaterBedStats `json:"heater_bed,omitempty"`
+	Webhooks  WebhooksStatus `json:"webhooks"`
+}
+
 type MoonrakerPrinterStats struct {
-	Result struct {
-		Status struct {
-			Stats     PrinterStats   `json:"print_stats"`
-			SDCard    VirtualSDCard  `json:"virtual_sdcard"`
-			Extruder  ExtruderStats  `json:"extruder,omitempty"`
-			HeaterBed HeaterBedStats `json:"heater_bed,omitempty"`
-		}
-		EventTime float64 `json:"eventtime"`
-	} `json:"result"`
+	Result MoonrakerSubscribeResult `json:"result"`
 }
 
 type PrinterInfoStatsPair struct {
@@ -99,6 +113,47 @@ type PrinterInfoStatsPair struct {
 	SDCard      VirtualSDCard   `json:"virtual_sdcard"`
 	Extruder    ExtruderStats   `json:"extruder,omitempty"`
 	HeaterBed   HeaterBedStats  `json:"heater_bed,omitempty"`
+	// every discovered extruder, the active one is from toolhead.extruder
+	Tools []ToolStats    `json:"tools,omitempty"`
+	Eta   *PrintEstimate `json:"eta,omitempty"`
+	// klipper state as seen by moonraker (ready, startup, shutdown, error, disconnected),
+	// empty when moonraker itself is unreachable
+	KlippyState  string `json:"klippy_state,omitempty"`
+	StateMessage string `json:"state_message,omitempty"`
+	// extra klipper objects requested via GTPrinterConfig.Objects, keyed by object then field
+	Objects MoonrakerObjects `json:"objects,omitempty"`
+	// active watchdog alerts
+	Alerts  []PrinterAlert `json:"alerts,omitempty"`
+	Stalled bool           `json:"stalled,omitempty"`
+	// bed was cleared since the last job, the print queue only uses cleared printers
+	Cleared bool `json:"cleared,omitempty"`
+	// only filled in by the printers api and stream, the poller reports to Diagnostics directly
+	Diagnostics *PrinterDiagnostics `json:"diagnostics,omitempty"`
+}
+
+// a zero threshold disables its rule
+type GTWatchdogConfig struct {
+	// temperature more than deviation_c off target for deviation_seconds, once the target was reached
+	DeviationC       float64 `json:"deviation_c,omitempty"`
+	DeviationSeconds int     `json:"deviation_seconds,omitempty"`
+	// above idle_max_c for idle_seconds while nothing is printing, target or not, e.g. a stuck ssr
+	IdleMaxC    float64 `json:"idle_max_c,omitempty"`
+	IdleSeconds int     `json:"idle_seconds,omitempty"`
+	// a heater target set while nothing is printing
+	TargetWithoutPrintSeconds int `json:"target_without_print_seconds,omitempty"`
+	// printing without the file position moving for this long is a stall,
+	// defaults to 30 minutes even without a watchdog config, -1 disables it
+	StallSeconds int `json:"stall_seconds,omitempty"`
+	// pause or emergency_stop, run once when a thermal alert is raised. pause only applies while printing.
+	Action string `json:"action,omitempty"`
+}
+
+// seconds, zero keeps the default
+type GTPollIntervals struct {
+	Printing int `json:"printing,omitempty"`
+	Idle     int `json:"idle,omitempty"`
+	// cap of the exponential backoff while the printer is offline
+	OfflineMax int `json:"offline_max,omitempty"`
 }
 
 type GTPrinterCamerasConfig struct {
@@ -107,6 +162,8 @@ type GTPrinterCamerasConfig struct {
 	CameraIp   string `json:"camera_ip"`
 	CameraPort int    `json:"camera_port"`
 	Type       string `json:"type"`
+	// https for cameras behind the printer's https moonraker_url, http otherwise
+	Scheme string `json:"scheme,omitempty"`
 }
 
 type GTPrinterConfig struct {
@@ -114,6 +171,45 @@ type GTPrinterConfig struct {
 	MoonrakerIP   string                   `json:"moonraker_ip"`
 	MoonrakerPort int                      `json:"moonraker_port"`
 	Cameras       []GTPrinterCamerasConfig `json:"cameras"`
+	// free form labels to address groups of printers, e.g. in bulk actions
+	Tags []string `json:"tags,omitempty"`
+	// http polling intervals, used whenever moonraker's websocket can't be
+	PollIntervals *GTPollIntervals `json:"poll_intervals,omitempty"`
+	// thermal rules checked on every update, nil disables them
+	Watchdog *GTWatchdogConfig `json:"watchdog,omitempty"`
+	// extra klipper objects to poll, e.g. "temperature_sensor chamber"
+	Objects []string `json:"objects,omitempty"`
+	// how remaining print time is estimated: slicer (default), file or filament
+	EtaMethod string `json:"eta_method,omitempty"`
+	// moonraker credentials, either an api key or a user login (jwt)
+	MoonrakerApiKey   string `json:"moonraker_api_key,omitempty"`
+	MoonrakerUsername string `json:"moonraker_username,omitempty"`
+	MoonrakerPassword string `json:"moonraker_password,omitempty"`
+	// add guppyflo's moonraker credentials to proxied requests
+	InjectAuth *bool `json:"inject_auth,omitempty"`
+	// full moonraker base url, e.g. https://host/moonraker-2/. takes precedence over ip/port.
+	MoonrakerUrl string `json:"moonraker_url,omitempty"`
+	// PEM encoded CA trusted in addition to the system roots. guppytunnel.json may
+	// also hold a path to one, the api only takes PEM.
+	MoonrakerCA        string `json:"moonraker_ca,omitempty"`
+	InsecureSkipVerify *bool  `json:"insecure_skip_verify,omitempty"`
+}
+
+// PUT /v1/api/printers body. secrets are never sent back to clients, so empty
+// credentials leave the saved ones alone and removing them has to be asked for.
+type GTPrinterUpdate struct {
+	GTPrinterConfig
+	// drops the api key, username and password before any sent ones are applied
+	ClearAuth bool `json:"clear_auth,omitempty"`
+	ClearCA   bool `json:"clear_ca,omitempty"`
+}
+
+// secrets stay in guppytunnel.json, api responses only get the username
+func (p PrinterInfoStatsPair) MarshalJSON() ([]byte, error) {
+	type printerInfoStatsPair PrinterInfoStatsPair
+	p.PrinterInfo.MoonrakerApiKey = ""
+	p.PrinterInfo.MoonrakerPassword = ""
+	return json.Marshal(printerInfoStatsPair(p))
 }
 
 type GTOAuthConfig struct {
@@ -121,14 +217,72 @@ type GTOAuthConfig struct {
 	OAuthEmails []string `json:"oauth_emails"`
 }
 
+type GTWebhookConfig struct {
+	Url string `json:"url"`
+	// payloads are signed with HMAC-SHA256 in X-GuppyFLO-Signature when set
+	Secret string `json:"secret,omitempty"`
+	// event types and printer ids to deliver, empty means all
+	Events   []string `json:"events,omitempty"`
+	Printers []string `json:"printers,omitempty"`
+}
+
+type GTMessageTemplate struct {
+	Title   string `json:"title,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type GTNotifierConfig struct {
+	Name string `json:"name,omitempty"`
+	// ntfy, gotify, discord, telegram, pushover or email
+	Type string `json:"type"`
+	// server or webhook url, optional for the hosted services
+	Url string `json:"url,omitempty"`
+	// ntfy access token, gotify app token, telegram bot token or pushover app token
+	Token  string `json:"token,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	ChatId string `json:"chat_id,omitempty"`
+	User   string `json:"user,omitempty"`
+	// event types and printer ids to notify about, empty means all
+	Events   []string `json:"events,omitempty"`
+	Printers []string `json:"printers,omitempty"`
+	// go text/templates rendered with the event, per event type templates win
+	Title     string                       `json:"title,omitempty"`
+	Message   string                       `json:"message,omitempty"`
+	Templates map[string]GTMessageTemplate `json:"templates,omitempty"`
+	// only for the email type
+	Smtp *GTSmtpConfig `json:"smtp,omitempty"`
+}
+
+type GTSmtpConfig struct {
+	Host string `json:"host"`
+	// defaults to 587, or 465 with implicit tls
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// starttls (default), tls or none
+	Security string   `json:"security,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
 type GTConfig struct {
 	Printers []GTPrinterConfig `json:"printers,omitempty"`
 	// Fluidd *string `json:"fluidd"`
 	// Mainsail *string `json:"mainsail"`
-	NgrokApiKey    *string         `json:"ngrok_api_key,omitempty"`
-	NgrokAuthToken *string         `json:"ngrok_auth_token,omitempty"`
-	OAuthConfig    []GTOAuthConfig `json:"oauth_config,omitempty"`
-	GuppyFloPort   int             `json:"guppyflo_local_port"`
+	NgrokApiKey    *string            `json:"ngrok_api_key,omitempty"`
+	NgrokAuthToken *string            `json:"ngrok_auth_token,omitempty"`
+	OAuthConfig    []GTOAuthConfig    `json:"oauth_config,omitempty"`
+	GuppyFloPort   int                `json:"guppyflo_local_port"`
+	Webhooks       []GTWebhookConfig  `json:"webhooks,omitempty"`
+	Notifiers      []GTNotifierConfig `json:"notifiers,omitempty"`
+	FileIndex      *GTFileIndexConfig `json:"file_index,omitempty"`
+}
+
+type GTFileIndexConfig struct {
+	// index the config root next to gcodes
+	IncludeConfig bool `json:"include_config,omitempty"`
+	// seconds between refreshes, defaults to 10 minutes
+	Interval int `json:"interval,omitempty"`
 }
 
 type GTUISettings struct {
@@ -160,6 +314,11 @@ func loadGTConfig(file string) GTConfig {
 	}
 	jsonParser := json.NewDecoder(cf)
 	jsonParser.Decode(&config)
+	for i := range config.Printers {
+		if err := normalizePrinterUrl(&config.Printers[i]); err != nil {
+			log.Println("Invalid moonraker url for printer", config.Printers[i].Name, err)
+		}
+	}
 	return config
 }
 
@@ -174,12 +333,12 @@ func saveGTConfig(c GTConfig) {
 	}
 }
 
-func gtConfigDeletePrinter(ip string, port int) {
+func gtConfigDeletePrinter(printerId string) {
 	GTConfigLock.Lock()
 	defer GTConfigLock.Unlock()
 	n := 0
 	for _, x := range gtconfig.Printers {
-		if x.MoonrakerIP != ip || x.MoonrakerPort != port {
+		if getPrinterId(x) != printerId {
 			gtconfig.Printers[n] = x
 			n++
 		}
@@ -202,6 +361,10 @@ func createNgrokToken(ctx context.Context, ngrokKey string) (*string, error) {
 var (
 	Printers            map[string]PrinterInfoStatsPair
 	PrinterQuitChannels map[string]chan bool
+	// lets handlers ask a running poller to pick up printer config changes
+	PrinterReloadChannels map[string]chan bool
+	// lets the proxy ask a poller for an immediate re-poll
+	PrinterWakeChannels map[string]chan bool
 	PrinterMuxes        map[string]*http.ServeMux
 	CameraMuxes         map[string]*http.ServeMux
 	PrintersMapLock     sync.RWMutex
@@ -242,7 +405,12 @@ func main() {
 		proxyPath := filepath.Join(*configDir, "proxies.json")
 		tcpproxy.Run(proxyPath)
 	} else {
-		if err := run(context.Background()); err != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := run(ctx)
+		stop()
+		// run returns on SIGINT/SIGTERM too, history since the last periodic save would be lost otherwise
+		savePrinterHistories()
+		if err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -252,6 +420,8 @@ func run(ctx context.Context) error {
 
 	Printers = make(map[string]PrinterInfoStatsPair)
 	PrinterQuitChannels = make(map[string]chan bool)
+	PrinterReloadChannels = make(map[string]chan bool)
+	PrinterWakeChannels = make(map[string]chan bool)
 	PrinterMuxes = make(map[string]*http.ServeMux)
 	CameraMuxes = make(map[string]*http.ServeMux)
 
@@ -263,6 +433,12 @@ func run(ctx context.Context) error {
 
 	startPrinterPoller(gtconfig.Printers)
 	startPrinterDataConsumer()
+	startHistoryPersister()
+	startEventDispatcher()
+	startWatchdogSweeper()
+	startJobHistorySync()
+	startQueueScheduler()
+	startFileIndexer()
 
 	enableNgrok := (gtconfig.NgrokApiKey != nil || gtconfig.NgrokAuthToken != nil) && len(gtconfig.OAuthConfig) > 0
 
@@ -287,7 +463,7 @@ func run(ctx context.Context) error {
 	// populate printers
 	PrintersMapLock.Lock()
 	for _, p := range gtconfig.Printers {
-		printerId := fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d", p.MoonrakerIP, p.MoonrakerPort)))
+		printerId := getPrinterId(p)
 		Printers[printerId] = PrinterInfoStatsPair{
 			PrinterId:   printerId,
 			PrinterInfo: p,
@@ -315,6 +491,18 @@ func run(ctx context.Context) error {
 		mux, exists := PrinterMuxes[printerId]
 		PrintersMapLock.RUnlock()
 		if exists {
+			target := "moonraker"
+			switch strings.SplitN(r.PathValue("rest"), "/", 2)[0] {
+			case "fluidd", "mainsail", "cameras":
+				target = strings.SplitN(r.PathValue("rest"), "/", 2)[0]
+			}
+			ProxyRequestsMetric.Inc(printerId, target)
+			if target == "fluidd" || target == "mainsail" {
+				// someone is looking at this printer, don't make them wait for a slow poll
+				PrintersMapLock.RLock()
+				wakePrinterPoller(printerId)
+				PrintersMapLock.RUnlock()
+			}
 			mux.ServeHTTP(w, r)
 			return
 		}
@@ -325,8 +513,25 @@ func run(ctx context.Context) error {
 	guppyMux.HandleFunc("GET /v1/api/cameras", func(w http.ResponseWriter, r *http.Request) {
 		ip := r.URL.Query().Get("ip")
 		port := r.URL.Query().Get("port")
-		if ip != "" && port != "" {
-			cameras := findCameras(ip, port)
+		moonrakerUrl := r.URL.Query().Get("url")
+		if moonrakerUrl != "" || (ip != "" && port != "") {
+			var cameras []GTPrinterCamerasConfig
+			if moonrakerUrl != "" {
+				p := GTPrinterConfig{MoonrakerUrl: moonrakerUrl}
+				if err := normalizePrinterUrl(&p); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				// an existing printer brings its credentials and CA along
+				PrintersMapLock.RLock()
+				if printer, exists := Printers[getPrinterId(p)]; exists {
+					p = printer.PrinterInfo
+				}
+				PrintersMapLock.RUnlock()
+				cameras = findUrlCameras(p, getMoonrakerCameras(p))
+			} else {
+				cameras = findCameras(ip, port)
+			}
 
 			w.Header().Set("Content-Type", "application/json")
 			err := json.NewEncoder(w).Encode(&cameras)
@@ -346,15 +551,8 @@ func run(ctx context.Context) error {
 			defer PrintersMapLock.RUnlock()
 			w.Header().Set("Content-Type", "application/json")
 
-			p := make([]PrinterInfoStatsPair, 0, len(Printers))
-			for _, v := range Printers {
-				p = append(p, v)
-			}
-
-			sort.SliceStable(p, func(a, b int) bool {
-				return p[a].PrinterId > p[b].PrinterId
-			})
-
+			p := getSortedPrinters()
+			addPrinterDiagnostics(p)
 			err := json.NewEncoder(w).Encode(&p)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -370,12 +568,17 @@ func run(ctx context.Context) error {
 				return
 			}
 
+			if err := validatePrinterConfig(&p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
 			PrintersMapLock.Lock()
-			printerId := fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d", p.MoonrakerIP, p.MoonrakerPort)))
+			printerId := getPrinterId(p)
 			_, exists := Printers[printerId]
 			if exists {
 				PrintersMapLock.Unlock()
-				http.Error(w, "Printer with same IP and Port already exists", http.StatusBadRequest)
+				http.Error(w, "Printer with same URL or IP and Port already exists", http.StatusBadRequest)
 				return
 			}
 
@@ -394,6 +597,7 @@ func run(ctx context.Context) error {
 			}
 
 			Printers[printerId] = newPrinter
+			PrinterStream.publishPrinter(newPrinter)
 			PrintersMapLock.Unlock()
 
 			startPrinterPoller([]GTPrinterConfig{p})
@@ -411,17 +615,23 @@ func run(ctx context.Context) error {
 			}
 		case "PUT":
 			decoder := json.NewDecoder(r.Body)
-			var p GTPrinterConfig
-			err := decoder.Decode(&p)
+			var update GTPrinterUpdate
+			err := decoder.Decode(&update)
 			if err != nil {
 				log.Println(err)
 				http.Error(w, "Failed to decode new printer json", http.StatusBadRequest)
 				return
 			}
+			p := update.GTPrinterConfig
+
+			if err := validatePrinterConfig(&p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
 			PrintersMapLock.Lock()
 			defer PrintersMapLock.Unlock()
-			printerId := fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d", p.MoonrakerIP, p.MoonrakerPort)))
+			printerId := getPrinterId(p)
 			printer, exists := Printers[printerId]
 			if !exists {
 				http.Error(w, "Printer doesn't exist for update", http.StatusBadRequest)
@@ -455,17 +665,64 @@ func run(ctx context.Context) error {
 			GTConfigLock.Lock()
 			defer GTConfigLock.Unlock()
 			pidx := slices.IndexFunc(gtconfig.Printers, func(p GTPrinterConfig) bool {
-				return p.MoonrakerIP == printer.PrinterInfo.MoonrakerIP && p.MoonrakerPort == printer.PrinterInfo.MoonrakerPort
+				return getPrinterId(p) == printerId
 			})
 
 			// save printer config
 			gtconfig.Printers[pidx].Cameras = p.Cameras
 			gtconfig.Printers[pidx].Name = p.Name
+			// clients that don't know about objects leave them untouched
+			if p.Objects != nil {
+				gtconfig.Printers[pidx].Objects = p.Objects
+			}
+			if p.Tags != nil {
+				gtconfig.Printers[pidx].Tags = p.Tags
+			}
+			if p.EtaMethod != "" {
+				gtconfig.Printers[pidx].EtaMethod = p.EtaMethod
+			}
+			// secrets are never sent back to clients, empty means unchanged
+			if update.ClearAuth {
+				gtconfig.Printers[pidx].MoonrakerApiKey = ""
+				gtconfig.Printers[pidx].MoonrakerUsername = ""
+				gtconfig.Printers[pidx].MoonrakerPassword = ""
+			}
+			if p.MoonrakerApiKey != "" {
+				gtconfig.Printers[pidx].MoonrakerApiKey = p.MoonrakerApiKey
+			}
+			if p.MoonrakerUsername != "" {
+				gtconfig.Printers[pidx].MoonrakerUsername = p.MoonrakerUsername
+			}
+			if p.MoonrakerPassword != "" {
+				gtconfig.Printers[pidx].MoonrakerPassword = p.MoonrakerPassword
+			}
+			if p.InjectAuth != nil {
+				gtconfig.Printers[pidx].InjectAuth = p.InjectAuth
+			}
+			if update.ClearCA {
+				gtconfig.Printers[pidx].MoonrakerCA = ""
+			}
+			if p.MoonrakerCA != "" {
+				gtconfig.Printers[pidx].MoonrakerCA = p.MoonrakerCA
+			}
+			if p.PollIntervals != nil {
+				gtconfig.Printers[pidx].PollIntervals = p.PollIntervals
+			}
+			if p.Watchdog != nil {
+				gtconfig.Printers[pidx].Watchdog = p.Watchdog
+			}
+			if p.InsecureSkipVerify != nil {
+				gtconfig.Printers[pidx].InsecureSkipVerify = p.InsecureSkipVerify
+			}
 			saveGTConfig(gtconfig)
+			resetMoonrakerAuth(printerId)
+			resetMoonrakerTransport(printerId)
 
 			// update in-mem printer obj
 			printer.PrinterInfo = gtconfig.Printers[pidx]
 			Printers[printerId] = printer
+			PrinterStream.publishPrinter(printer)
+			reloadPrinterPoller(printerId)
 
 			err = json.NewEncoder(w).Encode(&printer)
 			if err != nil {
@@ -485,6 +742,18 @@ func run(ctx context.Context) error {
 				}
 
 				delete(Printers, printerId)
+				PrinterStream.publishDelete(printerId)
+				deletePrinterHistory(printerId)
+				deletePrinterMetrics(printerId)
+				deleteJobHistory(printerId)
+				resetMoonrakerAuth(printerId)
+				resetMoonrakerTransport(printerId)
+				deletePrinterDiagnostics(printerId)
+				deletePrinterEvents(printerId)
+				deletePrinterWatchdog(printerId)
+				deletePrinterQueue(printerId)
+				deletePrinterMacros(printerId)
+				deletePrinterFiles(printerId)
 				quitChannel, exists := PrinterQuitChannels[printerId]
 				if exists && quitChannel != nil {
 					quitChannel <- true
@@ -504,7 +773,7 @@ func run(ctx context.Context) error {
 					delete(CameraMuxes, printerId)
 				}
 
-				gtConfigDeletePrinter(printer.PrinterInfo.MoonrakerIP, printer.PrinterInfo.MoonrakerPort)
+				gtConfigDeletePrinter(printer.PrinterId)
 				w.WriteHeader(http.StatusNoContent)
 			}
 
@@ -514,6 +783,38 @@ func run(ctx context.Context) error {
 
 	})
 
+	guppyMux.HandleFunc("GET /metrics", metricsHandler)
+	guppyMux.HandleFunc("GET /v1/api/printers/stream", printerStreamHandler)
+	guppyMux.HandleFunc("GET /v1/api/printers/{printerId}/history", printerHistoryHandler)
+	guppyMux.HandleFunc("GET /v1/api/printers/{printerId}/thumbnail", printerThumbnailHandler)
+	guppyMux.HandleFunc("GET /v1/api/printers/{printerId}/diagnostics", printerDiagnosticsHandler)
+	guppyMux.HandleFunc("GET /v1/api/printers/{printerId}/snapshot", printerSnapshotHandler)
+	guppyMux.HandleFunc("GET /v1/api/history", jobHistoryHandler)
+	guppyMux.HandleFunc("GET /v1/api/alerts", alertsHandler)
+	guppyMux.HandleFunc("POST /v1/api/printers/{printerId}/actions", printerActionHandler)
+	guppyMux.HandleFunc("POST /v1/api/actions", bulkActionHandler)
+	guppyMux.HandleFunc("POST /v1/api/gcode", gcodeHandler)
+	guppyMux.HandleFunc("GET /v1/api/macros", fleetMacrosHandler)
+	guppyMux.HandleFunc("/v1/api/files", filesHandler)
+	guppyMux.HandleFunc("GET /v1/api/printers/{printerId}/files/metadata", fileMetadataHandler)
+	guppyMux.HandleFunc("DELETE /v1/api/printers/{printerId}/files", deleteFileHandler)
+	guppyMux.HandleFunc("POST /v1/api/printers/{printerId}/files/copy", copyFileHandler)
+	guppyMux.HandleFunc("POST /v1/api/macros/{name}", runFleetMacroHandler)
+	guppyMux.HandleFunc("GET /v1/api/printers/{printerId}/macros", printerMacrosHandler)
+	guppyMux.HandleFunc("POST /v1/api/printers/{printerId}/macros/{name}", runPrinterMacroHandler)
+	guppyMux.HandleFunc("POST /v1/api/dispatches", dispatchHandler)
+	guppyMux.HandleFunc("GET /v1/api/dispatches/{dispatchId}", dispatchStatusHandler)
+	guppyMux.HandleFunc("GET /v1/api/dispatches/{dispatchId}/stream", dispatchStreamHandler)
+	guppyMux.HandleFunc("GET /v1/api/uploads", uploadsHandler)
+	guppyMux.HandleFunc("POST /v1/api/uploads", uploadHandler)
+	guppyMux.HandleFunc("DELETE /v1/api/uploads/{filename}", deleteUploadHandler)
+	guppyMux.HandleFunc("/v1/api/queue", queueHandler)
+	guppyMux.HandleFunc("POST /v1/api/queue/{jobId}/cancel", cancelQueueJobHandler)
+	guppyMux.HandleFunc("POST /v1/api/queue/{jobId}/retry", retryQueueJobHandler)
+	guppyMux.HandleFunc("DELETE /v1/api/queue/{jobId}", deleteQueueJobHandler)
+	guppyMux.HandleFunc("POST /v1/api/printers/{printerId}/cleared", printerClearedHandler)
+	guppyMux.HandleFunc("DELETE /v1/api/printers/{printerId}/cleared", printerClearedHandler)
+
 	guppyMux.HandleFunc("/v1/api/settings", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
@@ -635,6 +936,7 @@ func run(ctx context.Context) error {
 
 			if status.BackendState != "NeedsLogin" && status.BackendState != "NoState" {
 				log.Printf("ts already authenticated")
+				TunnelUpMetric.Set(1, "tailscale")
 				if status.AuthURL == "" {
 					GTConfigLock.Lock()
 					TSAuthURL = status.AuthURL
@@ -656,9 +958,14 @@ func run(ctx context.Context) error {
 		http.Serve(tsListener, guppyMux)
 	}()
 
+	TunnelUpMetric.Set(0, "tailscale")
+	TunnelUpMetric.Set(0, "ngrok")
+
 	if !enableNgrok {
 		log.Println("Serving GuppyFLO locally on port", gtconfig.GuppyFloPort)
-		return http.ListenAndServe(fmt.Sprintf(":%d", gtconfig.GuppyFloPort), guppyMux) //local
+		return serveUntilDone(ctx, func() error {
+			return http.ListenAndServe(fmt.Sprintf(":%d", gtconfig.GuppyFloPort), guppyMux) //local
+		})
 	}
 
 	var oauths []config.HTTPEndpointOption
@@ -689,16 +996,35 @@ func run(ctx context.Context) error {
 	}
 
 	log.Println("Serving GuppyFLO remotely at:", ln.URL())
+	TunnelUpMetric.Set(1, "ngrok")
 
 	go func() {
 		log.Println("Serving GuppyFLO locally on port", gtconfig.GuppyFloPort)
 		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", gtconfig.GuppyFloPort), guppyMux)) //local
 	}()
 
-	return http.Serve(ln, guppyMux) // ngrok
+	return serveUntilDone(ctx, func() error {
+		return http.Serve(ln, guppyMux) // ngrok
+	})
 
 }
 
+// serve blocks until it fails or ctx is done, the latter isn't an error
+func serveUntilDone(ctx context.Context, serve func() error) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		log.Println("Shutting down GuppyFLO")
+		return nil
+	}
+}
+
 func reverseProxyHandler(p *httputil.ReverseProxy, url *url.URL) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		req.Header.Add("X-Scheme", "http")
@@ -710,16 +1036,69 @@ func reverseProxyHandler(p *httputil.ReverseProxy, url *url.URL) func(http.Respo
 	}
 }
 
+// callers must hold PrintersMapLock
+func getSortedPrinters() []PrinterInfoStatsPair {
+	p := make([]PrinterInfoStatsPair, 0, len(Printers))
+	for _, v := range Printers {
+		p = append(p, v)
+	}
+
+	sort.SliceStable(p, func(a, b int) bool {
+		return p[a].PrinterId > p[b].PrinterId
+	})
+
+	return p
+}
+
 func hash(s string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(s))
 	return h.Sum32()
 }
 
+// checks a printer config sent to the printers api, normalizing its moonraker url
+func validatePrinterConfig(p *GTPrinterConfig) error {
+	if p.EtaMethod != "" && !slices.Contains(EtaMethods, p.EtaMethod) {
+		return errors.New("Unknown eta_method")
+	}
+
+	if err := normalizePrinterUrl(p); err != nil {
+		return err
+	}
+
+	if i := p.PollIntervals; i != nil && (i.Printing < 0 || i.Idle < 0 || i.OfflineMax < 0) {
+		return errors.New("poll_intervals can't be negative")
+	}
+
+	if wd := p.Watchdog; wd != nil && wd.Action != "" && !slices.Contains(WatchdogActions, wd.Action) {
+		return errors.New("Unknown watchdog action")
+	}
+
+	if p.MoonrakerCA != "" {
+		// a path would let api clients make guppyflo read any file, paths can only
+		// be set by editing guppytunnel.json
+		if !isPemCA(p.MoonrakerCA) {
+			return errors.New("moonraker_ca must be PEM encoded certificates")
+		}
+		if _, err := loadMoonrakerCA(p.MoonrakerCA); err != nil {
+			return fmt.Errorf("Invalid moonraker_ca: %w", err)
+		}
+	}
+	return nil
+}
+
+// printers behind the same host can only be told apart by their url path
+func getPrinterId(p GTPrinterConfig) string {
+	if p.MoonrakerUrl != "" {
+		return fmt.Sprintf("%d", hash(strings.TrimSuffix(p.MoonrakerUrl, "/")))
+	}
+	return fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d", p.MoonrakerIP, p.MoonrakerPort)))
+}
+
 func startPrinterPoller(printers []GTPrinterConfig) {
 	PrintersMapLock.Lock()
 	for _, p := range printers {
-		printerId := fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d", p.MoonrakerIP, p.MoonrakerPort)))
+		printerId := getPrinterId(p)
 		Printers[printerId] = PrinterInfoStatsPair{
 			PrinterId:   printerId,
 			PrinterInfo: p,
@@ -732,68 +1111,8 @@ func startPrinterPoller(printers []GTPrinterConfig) {
 	PrintersMapLock.Unlock()
 
 	for _, printer := range printers {
-		// printerId := fmt.Sprintf("printer%d", i)
 		quitSignal := make(chan bool)
-		go func(p GTPrinterConfig, quit chan bool) {
-			log.Println("Connecting to printer at:", p.MoonrakerIP, p.MoonrakerPort)
-			printerId := fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d", p.MoonrakerIP, p.MoonrakerPort)))
-			// log.PrintLno("Starting fetcher for printer at ", p.MoonrakerIP, p.MoonrakerPort)
-			maxFailedAttempt := 3
-			printerUrl := fmt.Sprintf("http://%v:%v/printer/objects/query?print_stats&virtual_sdcard&extruder&heater_bed",
-				p.MoonrakerIP, p.MoonrakerPort)
-			for _ = range time.Tick(3 * time.Second) {
-				// log.Println("getting from ", printerUrl, now)
-				select {
-				case <-quit:
-					log.Println("Stop polling for printer", p.MoonrakerIP, p.MoonrakerPort)
-					return
-				default:
-					resp, err := client.Get(printerUrl)
-					if err != nil {
-						maxFailedAttempt--
-
-						if maxFailedAttempt <= 0 {
-							maxFailedAttempt = 3
-
-							// log.Println("failed 3 consective attempts, marking printer as offline")
-
-							c <- Pair[PrinterInfoStatsPair, chan bool]{
-								First: PrinterInfoStatsPair{
-									PrinterId: printerId,
-									Stats: PrinterStats{
-										State: "offline",
-									},
-									SDCard: VirtualSDCard{},
-								},
-								Second: quit,
-							}
-						}
-						continue
-					}
-
-					maxFailedAttempt = 3
-
-					defer resp.Body.Close()
-					var moonrakerResult MoonrakerPrinterStats
-					err = json.NewDecoder(resp.Body).Decode(&moonrakerResult)
-
-					if err != nil {
-						log.Println("error decoding pstats", err)
-					}
-
-					c <- Pair[PrinterInfoStatsPair, chan bool]{
-						First: PrinterInfoStatsPair{
-							PrinterId: printerId,
-							Stats:     moonrakerResult.Result.Status.Stats,
-							SDCard:    moonrakerResult.Result.Status.SDCard,
-							Extruder:  moonrakerResult.Result.Status.Extruder,
-							HeaterBed: moonrakerResult.Result.Status.HeaterBed,
-						},
-						Second: quit,
-					}
-				}
-			}
-		}(printer, quitSignal)
+		go pollPrinter(printer, quitSignal)
 	}
 }
 
@@ -811,10 +1130,20 @@ func startPrinterDataConsumer() {
 			}
 
 			// continue to add/update the printer
-			ps.First.PrinterInfo = Printers[ps.First.PrinterId].PrinterInfo
+			prev := Printers[ps.First.PrinterId]
+			ps.First.PrinterInfo = prev.PrinterInfo
+			alerts, raised := evaluateWatchdog(ps.First)
+			ps.First.Alerts = alerts
+			ps.First.Stalled = isStalled(alerts)
+			ps.First.Cleared = isPrinterCleared(ps.First.PrinterId)
 			Printers[ps.First.PrinterId] = ps.First
 			PrinterQuitChannels[ps.First.PrinterId] = ps.Second
+			PrinterStream.publishPrinter(ps.First)
 			PrintersMapLock.Unlock()
+
+			recordPrinterHistory(ps.First)
+			emitPrinterEvents(detectPrinterEvents(prev, ps.First))
+			raiseAlerts(ps.First, raised)
 		}
 	}()
 
@@ -854,7 +1183,7 @@ func setupMoonrakerAndUIRoutes(
 		if !exists {
 			visitedCameras[camPath] = camPath
 
-			cameraUrl, err2 := url.Parse(fmt.Sprintf("http://%s:%d", cam.CameraIp, cam.CameraPort))
+			cameraUrl, err2 := url.Parse(cameraBaseUrl(cam))
 			if err2 != nil {
 				log.Println("Failed to create URL from for printer cameras", cam.CameraIp, cam.CameraPort)
 			}
@@ -864,6 +1193,7 @@ func setupMoonrakerAndUIRoutes(
 			if len(pathParts) > 1 && (!strings.Contains(pathParts[0], "?") && !strings.Contains(pathParts[0], "=")) {
 				cameraPrefix := fmt.Sprintf(prefix+"/%s/", pathParts[0])
 				cameraProxy := httputil.NewSingleHostReverseProxy(cameraUrl)
+				cameraProxy.Transport = moonrakerProxy.Transport
 
 				log.Println("Creating camera routes at", cameraUrl, cameraPrefix)
 
@@ -888,26 +1218,33 @@ func setupPrinterRoutes(printers []GTPrinterConfig,
 	mainsailProxy *httputil.ReverseProxy) {
 
 	for _, p := range printers {
-		remote, err := url.Parse(fmt.Sprintf("http://%s:%d", p.MoonrakerIP, p.MoonrakerPort))
+		remote, err := url.Parse(moonrakerBaseUrl(p))
 		if err != nil {
-			log.Println("Failed to create URL from printer IP/Port", p.MoonrakerIP, p.MoonrakerPort)
+			log.Println("Failed to create URL from printer", moonrakerBaseUrl(p))
 			continue
 		}
 
 		// try to discover camera port for relative camera paths
-		moonrakerCams := getMoonrakerCameras(p.MoonrakerIP, strconv.Itoa(p.MoonrakerPort))
-		autoDetectedCams := findCameras(p.MoonrakerIP, strconv.Itoa(p.MoonrakerPort))
+		moonrakerCams := getMoonrakerCameras(p)
 
 		configurableCams := make(map[string]GTPrinterCamerasConfig)
-		for _, mc := range moonrakerCams {
-			for _, detectedCam := range autoDetectedCams {
-				if mc.UrlStream == detectedCam.Path {
-					cameraId := getCameraId(detectedCam)
-					_, exists := configurableCams[cameraId]
-					if !exists {
-						configurableCams[cameraId] = detectedCam
+		if p.MoonrakerUrl != "" {
+			// the streams are served next to moonraker, not on the well known ports
+			for _, cam := range findUrlCameras(p, moonrakerCams) {
+				configurableCams[cam.Id] = cam
+			}
+		} else {
+			autoDetectedCams := findCameras(p.MoonrakerIP, strconv.Itoa(p.MoonrakerPort))
+			for _, mc := range moonrakerCams {
+				for _, detectedCam := range autoDetectedCams {
+					if mc.UrlStream == detectedCam.Path {
+						cameraId := getCameraId(detectedCam)
+						_, exists := configurableCams[cameraId]
+						if !exists {
+							configurableCams[cameraId] = detectedCam
+						}
+						break
 					}
-					break
 				}
 			}
 		}
@@ -922,8 +1259,10 @@ func setupPrinterRoutes(printers []GTPrinterConfig,
 		}
 
 		printerMux := http.NewServeMux()
-		printerId := fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d", p.MoonrakerIP, p.MoonrakerPort)))
+		printerId := getPrinterId(p)
 		proxy := httputil.NewSingleHostReverseProxy(remote)
+		proxy.Transport = printerTransport(printerId)
+		injectMoonrakerAuth(proxy, printerId)
 		fluiddPrefix := printerId + "/fluidd"
 		mainsailPrefix := printerId + "/mainsail"
 
@@ -942,6 +1281,9 @@ func setupPrinterRoutes(printers []GTPrinterConfig,
 				mux, exists := CameraMuxes[printerId]
 				PrintersMapLock.RUnlock()
 				if exists {
+					CameraRequestsMetric.Inc(printerId)
+					CameraConnectionsMetric.Inc(printerId)
+					defer CameraConnectionsMetric.Dec(printerId)
 					mux.ServeHTTP(w, r)
 					return
 				}
@@ -974,13 +1316,15 @@ func setupCameraMuxes(cameras []GTPrinterCamerasConfig, printerId string) *http.
 			if !exists {
 				visitedCameras[cameraId] = cameraId
 
-				cameraUrl, err2 := url.Parse(fmt.Sprintf("http://%s:%d", cam.CameraIp, cam.CameraPort))
+				cameraUrl, err2 := url.Parse(cameraBaseUrl(cam))
 				if err2 != nil {
 					log.Println("Failed to create URL from for printer cameras", cam.CameraIp, cam.CameraPort)
 				}
 
 				cameraPrefix := fmt.Sprintf("%s/%s/", printerCameraPrefix, cameraId)
 				cameraProxy := httputil.NewSingleHostReverseProxy(cameraUrl)
+				// cameras behind the printer's https url need its CA too
+				cameraProxy.Transport = printerTransport(printerId)
 
 				log.Println("Creating camera routes at", cameraUrl, cameraPrefix)
 
@@ -1163,10 +1507,85 @@ func findCameras(ip string, port string) []GTPrinterCamerasConfig {
 	return cameras
 }
 
-func getMoonrakerCameras(ip string, port string) []CameraInfo {
-	camUrl := fmt.Sprintf("http://%v:%v/server/webcams/list",
-		ip, port)
-	resp, err := client.Get(camUrl)
+// moonraker's webcams resolved against the printer's moonraker_url, so they keep its
+// scheme and path prefix. each stream is checked with the printer's CA and credentials.
+func findUrlCameras(p GTPrinterConfig, webcams []CameraInfo) []GTPrinterCamerasConfig {
+	cameras := make([]GTPrinterCamerasConfig, 0)
+	base, err := url.Parse(moonrakerBaseUrl(p) + "/")
+	if err != nil {
+		return cameras
+	}
+
+	c, err := moonrakerClient(p)
+	if err != nil {
+		log.Println("Failed to detect cameras for", moonrakerBaseUrl(p), err)
+		return cameras
+	}
+	header, err := moonrakerAuthHeader(p)
+	if err != nil {
+		log.Println("Failed to detect cameras for", moonrakerBaseUrl(p), err)
+		return cameras
+	}
+
+	for _, webcam := range webcams {
+		ref, err := url.Parse(webcam.UrlStream)
+		if err != nil || webcam.UrlStream == "" {
+			continue
+		}
+		stream := base.ResolveReference(ref)
+		log.Println("Checking camera path", stream)
+
+		req, err := http.NewRequest(http.MethodGet, stream.String(), nil)
+		if err != nil {
+			continue
+		}
+		// credentials only go to moonraker's own host
+		if stream.Host == base.Host {
+			for k, v := range header {
+				req.Header[k] = v
+			}
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			continue
+		}
+		// streams never end, the headers are enough
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		port := 80
+		if stream.Scheme == "https" {
+			port = 443
+		}
+		if stream.Port() != "" {
+			if port, err = strconv.Atoi(stream.Port()); err != nil {
+				continue
+			}
+		}
+
+		camType := "mjpeg-stream"
+		if strings.Contains(webcam.Service, "go2rtc") {
+			camType = "go2rtc"
+		}
+		cam := GTPrinterCamerasConfig{
+			Type:       camType,
+			CameraIp:   stream.Hostname(),
+			CameraPort: port,
+			Path:       fmt.Sprintf("%s?%s", stream.Path, stream.RawQuery),
+			Scheme:     stream.Scheme,
+		}
+		cam.Id = getCameraId(cam)
+		cameras = append(cameras, cam)
+	}
+
+	log.Println("auto detected cameras", cameras)
+	return cameras
+}
+
+func getMoonrakerCameras(p GTPrinterConfig) []CameraInfo {
+	resp, err := moonrakerRequest(p, http.MethodGet, "/server/webcams/list", nil, "")
 
 	if err != nil {
 		return nil
@@ -1194,6 +1613,14 @@ func getMoonrakerCameras(ip string, port string) []CameraInfo {
 	return cams
 }
 
+func cameraBaseUrl(cam GTPrinterCamerasConfig) string {
+	scheme := "http"
+	if cam.Scheme != "" {
+		scheme = cam.Scheme
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, cam.CameraIp, cam.CameraPort)
+}
+
 func getCameraId(cam GTPrinterCamerasConfig) string {
 	return fmt.Sprintf("%d", hash(fmt.Sprintf("%s:%d%s", cam.CameraIp, cam.CameraPort, cam.Path)))
 
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// minimal prometheus text exposition, a client library is a lot of weight for mipsle builds
+type MetricVec struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(name string, metricType string, help string, labels ...string) *MetricVec {
+	return &MetricVec{
+		Name:   name,
+		Help:   help,
+		Type:   metricType,
+		Labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+var (
+	ProxyRequestsMetric = newMetricVec("guppyflo_proxy_requests_total", "counter",
+		"Requests proxied to a printer.", "printer_id", "target")
+	PollFailuresMetric = newMetricVec("guppyflo_poll_failures_total", "counter",
+		"Failed attempts to fetch printer state from moonraker.", "printer_id", "transport")
+	CameraConnectionsMetric = newMetricVec("guppyflo_camera_connections", "gauge",
+		"Open connections to proxied cameras.", "printer_id")
+	CameraRequestsMetric = newMetricVec("guppyflo_camera_requests_total", "counter",
+		"Requests proxied to printer cameras.", "printer_id")
+	TunnelUpMetric = newMetricVec("guppyflo_tunnel_up", "gauge",
+		"Whether a remote access tunnel is connected.", "tunnel")
+
+	processMetrics = []*MetricVec{
+		ProxyRequestsMetric,
+		PollFailuresMetric,
+		CameraConnectionsMetric,
+		CameraRequestsMetric,
+		TunnelUpMetric,
+	}
+
+	printerStates = []string{"standby", "printing", "paused", "complete", "cancelled", "error", "offline"}
+)
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func labelsKey(labels []string, values []string) string {
+	pairs := make([]string, 0, len(labels))
+	for i, l := range labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escapeLabelValue(v)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *MetricVec) Add(v float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[labelsKey(m.Labels, labelValues)] += v
+}
+
+func (m *MetricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *MetricVec) Dec(labelValues ...string) {
+	m.Add(-1, labelValues...)
+}
+
+func (m *MetricVec) Set(v float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[labelsKey(m.Labels, labelValues)] = v
+}
+
+func (m *MetricVec) Delete(labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.values, labelsKey(m.Labels, labelValues))
+}
+
+// drops every series carrying the label value, e.g. all series of a deleted printer
+func (m *MetricVec) DeleteLabel(label string, value string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pair := fmt.Sprintf(`%s="%s"`, label, escapeLabelValue(value))
+	for k := range m.values {
+		if slices.Contains(strings.Split(k, ","), pair) {
+			delete(m.values, k)
+		}
+	}
+}
+
+func deletePrinterMetrics(printerId string) {
+	for _, m := range processMetrics {
+		m.DeleteLabel("printer_id", printerId)
+	}
+}
+
+func (m *MetricVec) Write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %v\n", m.Name, k, m.values[k])
+	}
+}
+
+// printer gauges are built from the current fleet state on every scrape so
+// removed printers disappear without bookkeeping
+func writePrinterMetrics(w io.Writer) {
+	PrintersMapLock.RLock()
+	printers := getSortedPrinters()
+	PrintersMapLock.RUnlock()
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(p PrinterInfoStatsPair) float64
+	}{
+		{"guppyflo_printer_extruder_temperature_celsius", "Extruder temperature.",
+			func(p PrinterInfoStatsPair) float64 { return p.Extruder.Temperature }},
+		{"guppyflo_printer_extruder_target_celsius", "Extruder target temperature.",
+			func(p PrinterInfoStatsPair) float64 { return p.Extruder.Target }},
+		{"guppyflo_printer_heater_bed_temperature_celsius", "Heater bed temperature.",
+			func(p PrinterInfoStatsPair) float64 { return p.HeaterBed.Temperature }},
+		{"guppyflo_printer_heater_bed_target_celsius", "Heater bed target temperature.",
+			func(p PrinterInfoStatsPair) float64 { return p.HeaterBed.Target }},
+		{"guppyflo_printer_progress_ratio", "Print progress from virtual_sdcard (0-1).",
+			func(p PrinterInfoStatsPair) float64 { return p.SDCard.Progress }},
+		{"guppyflo_printer_print_duration_seconds", "Time spent printing the current job.",
+			func(p PrinterInfoStatsPair) float64 { return p.Stats.PrintDuration }},
+		{"guppyflo_printer_filament_used_millimeters", "Filament used by the current job.",
+			func(p PrinterInfoStatsPair) float64 { return p.Stats.Filamentused }},
+	}
+
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, p := range printers {
+			// no sample beats a misleading zero, the state gauge below still says why
+			if p.Stats.State == "offline" || klippyNotReady(p) {
+				continue
+			}
+			fmt.Fprintf(w, "%s{%s} %v\n", g.name,
+				labelsKey([]string{"printer_id", "printer_name"}, []string{p.PrinterId, p.PrinterInfo.Name}),
+				g.value(p))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP guppyflo_printer_state Current print_stats state, 1 for the active state.\n")
+	fmt.Fprintf(w, "# TYPE guppyflo_printer_state gauge\n")
+	for _, p := range printers {
+		for _, state := range printerStates {
+			v := 0
+			if p.Stats.State == state {
+				v = 1
+			}
+			fmt.Fprintf(w, "guppyflo_printer_state{%s} %d\n",
+				labelsKey([]string{"printer_id", "printer_name", "state"}, []string{p.PrinterId, p.PrinterInfo.Name, state}),
+				v)
+		}
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writePrinterMetrics(w)
+	for _, m := range processMetrics {
+		m.Write(w)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWritePrinterMetricsSkipsUnavailablePrinters(t *testing.T) {
+	prevPrinters := Printers
+	t.Cleanup(func() { Printers = prevPrinters })
+	Printers = map[string]PrinterInfoStatsPair{
+		"ready": {
+			PrinterId:   "ready",
+			Stats:       PrinterStats{State: "printing"},
+			Extruder:    ExtruderStats{Temperature: 210},
+			KlippyState: "ready",
+		},
+		// unreachable, everything but the state is a zero value
+		"offline": {
+			PrinterId: "offline",
+			Stats:     PrinterStats{State: "offline"},
+		},
+		"shutdown": {
+			PrinterId:   "shutdown",
+			KlippyState: "shutdown",
+		},
+	}
+
+	var b strings.Builder
+	writePrinterMetrics(&b)
+	out := b.String()
+
+	if !strings.Contains(out, `guppyflo_printer_extruder_temperature_celsius{printer_id="ready",printer_name=""} 210`) {
+		t.Errorf("ready printer's temperature is missing:\n%s", out)
+	}
+	for _, id := range []string{"offline", "shutdown"} {
+		if strings.Contains(out, `guppyflo_printer_extruder_temperature_celsius{printer_id="`+id+`"`) {
+			t.Errorf("%s printer has a temperature sample:\n%s", id, out)
+		}
+	}
+	if !strings.Contains(out, `guppyflo_printer_state{printer_id="offline",printer_name="",state="offline"} 1`) {
+		t.Errorf("offline printer's state is missing:\n%s", out)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+type JsonRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *JsonRpcError) Error() string {
+	return fmt.Sprintf("moonraker rpc error %d: %s", e.Code, e.Message)
+}
+
+type JsonRpcRequest struct {
+	JsonRpc string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+	Id      int    `json:"id"`
+}
+
+type JsonRpcMessage struct {
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *JsonRpcError   `json:"error,omitempty"`
+	Id     *int            `json:"id,omitempty"`
+}
+
+// status of klipper objects keyed by object name then field name. fields are
+// kept raw so partial updates from notify_status_update can be merged in place.
+type MoonrakerObjects map[string]map[string]json.RawMessage
+
+func (o MoonrakerObjects) merge(update MoonrakerObjects) {
+	for name, fields := range update {
+		obj, exists := o[name]
+		if !exists {
+			obj = make(map[string]json.RawMessage)
+			o[name] = obj
+		}
+		for k, v := range fields {
+			obj[k] = v
+		}
+	}
+}
+
+func (o MoonrakerObjects) decode(v any) error {
+	content, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func decodeObject(fields map[string]json.RawMessage, v any) error {
+	content, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func moonrakerUrl(p GTPrinterConfig, path string) string {
+	return moonrakerBaseUrl(p) + path
+}
+
+func moonrakerWebsocketUrl(p GTPrinterConfig) string {
+	base := moonrakerBaseUrl(p)
+	if strings.HasPrefix(base, "https://") {
+		return "wss://" + strings.TrimPrefix(base, "https://") + "/websocket"
+	}
+	return "ws://" + strings.TrimPrefix(base, "http://") + "/websocket"
+}
+
+// sends an authenticated request to the printer's moonraker. bodiless requests
+// are retried once with a fresh token when moonraker rejects the current one.
+func moonrakerRequest(p GTPrinterConfig, method string, path string, body io.Reader, contentType string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, moonrakerUrl(p, path), body)
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		header, err := moonrakerAuthHeader(p)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		c, err := moonrakerClient(p)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && p.MoonrakerUsername != "" && body == nil && attempt == 0 {
+			resp.Body.Close()
+			getMoonrakerAuth(getPrinterId(p)).invalidate()
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// like moonrakerRequest but for file transfers, which take longer than the usual
+// timeout. the context bounds them instead.
+func moonrakerTransfer(ctx context.Context, p GTPrinterConfig, method string, path string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, moonrakerUrl(p, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	header, err := moonrakerAuthHeader(p)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	transport, err := getMoonrakerTransport(p)
+	if err != nil {
+		return nil, err
+	}
+	c := http.Client{Transport: transport}
+	return c.Do(req)
+}
+
+// GETs a moonraker endpoint and decodes its result field into v
+func moonrakerGetResult(p GTPrinterConfig, path string, v any) error {
+	resp, err := moonrakerRequest(p, http.MethodGet, path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &MoonrakerStatusError{Path: path, Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	result := struct {
+		Result any `json:"result"`
+	}{v}
+	return json.NewDecoder(resp.Body).Decode(&result)
+}
+
+type MoonrakerServerInfo struct {
+	KlippyConnected  bool   `json:"klippy_connected"`
+	KlippyState      string `json:"klippy_state"`
+	MoonrakerVersion string `json:"moonraker_version"`
+}
+
+type MoonrakerSubscribeResult struct {
+	Status    MoonrakerObjects `json:"status"`
+	EventTime float64          `json:"eventtime"`
+}
+
+// calls without a deadline of their own give up after this, a moonraker that
+// stops answering shouldn't hang the caller until the connection drops
+const moonrakerCallTimeout = 10 * time.Second
+
+type MoonrakerSocket struct {
+	conn    *websocket.Conn
+	lock    sync.Mutex
+	nextId  int
+	pending map[int]chan JsonRpcMessage
+	done    chan struct{}
+	err     error
+
+	// status updates that didn't fit into Notifications, merged into one until
+	// the consumer catches up. non-nil while later updates have to queue behind it.
+	overflow        MoonrakerObjects
+	overflowTime    json.RawMessage
+	overflowReady   chan struct{}
+	overflowStopped chan struct{}
+
+	// server initiated notifications (e.g. notify_status_update), closed when the socket dies
+	Notifications chan JsonRpcMessage
+}
+
+func dialMoonrakerSocket(ctx context.Context, wsUrl string, header http.Header, transport http.RoundTripper) (*MoonrakerSocket, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(dialCtx, wsUrl, &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: transport},
+		HTTPHeader: header,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// objects.list and configfile responses easily exceed the 32KB default
+	conn.SetReadLimit(4 * 1024 * 1024)
+
+	s := &MoonrakerSocket{
+		conn:            conn,
+		pending:         make(map[int]chan JsonRpcMessage),
+		done:            make(chan struct{}),
+		overflowReady:   make(chan struct{}, 1),
+		overflowStopped: make(chan struct{}),
+		Notifications:   make(chan JsonRpcMessage, 256),
+	}
+	go s.forwardOverflow()
+	go s.readLoop(ctx)
+	return s, nil
+}
+
+func moonrakerIdentity(p GTPrinterConfig, header http.Header) map[string]string {
+	identity := map[string]string{
+		"client_name": "GuppyFLO",
+		"version":     "1.0.0",
+		"type":        "other",
+		"url":         "https://github.com/ballaswag/guppyflo",
+	}
+	// also authenticates the connection in case the upgrade headers were dropped on the way
+	if p.MoonrakerApiKey != "" {
+		identity["api_key"] = p.MoonrakerApiKey
+	} else if token := strings.TrimPrefix(header.Get("Authorization"), "Bearer "); token != "" {
+		identity["access_token"] = token
+	}
+	return identity
+}
+
+// dials the printer's moonraker websocket and identifies as guppyflo
+func connectMoonrakerSocket(ctx context.Context, p GTPrinterConfig) (*MoonrakerSocket, error) {
+	header, err := moonrakerAuthHeader(p)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := getMoonrakerTransport(p)
+	if err != nil {
+		return nil, err
+	}
+
+	socket, err := dialMoonrakerSocket(ctx, moonrakerWebsocketUrl(p), header, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := socket.Call(ctx, "server.connection.identify", moonrakerIdentity(p, header), nil); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+// the reader never blocks on the consumer, otherwise a Call made from the
+// goroutine draining Notifications would wait for a response that's never read
+func (s *MoonrakerSocket) readLoop(ctx context.Context) {
+	defer func() {
+		<-s.overflowStopped
+		close(s.Notifications)
+	}()
+	for {
+		_, data, err := s.conn.Read(ctx)
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+
+		var msg JsonRpcMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		if msg.Id != nil {
+			s.lock.Lock()
+			respChan, exists := s.pending[*msg.Id]
+			delete(s.pending, *msg.Id)
+			s.lock.Unlock()
+			if exists {
+				respChan <- msg
+			}
+			continue
+		}
+
+		if msg.Method == "notify_status_update" && s.queueStatus(msg) {
+			continue
+		}
+		if msg.Method != "" {
+			select {
+			case s.Notifications <- msg:
+			default:
+				log.Println("Moonraker notifications backed up, dropping", msg.Method)
+			}
+		}
+	}
+}
+
+// status updates are deltas, dropping one would leave stale fields behind. when
+// the consumer falls behind they are merged and handed over once there's room.
+func (s *MoonrakerSocket) queueStatus(msg JsonRpcMessage) bool {
+	var params []json.RawMessage
+	var status MoonrakerObjects
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+		return false
+	}
+	if err := json.Unmarshal(params[0], &status); err != nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.overflow == nil {
+		select {
+		case s.Notifications <- msg:
+			return true
+		default:
+			s.overflow = make(MoonrakerObjects)
+		}
+	}
+
+	s.overflow.merge(status)
+	if len(params) > 1 {
+		s.overflowTime = params[1]
+	}
+	select {
+	case s.overflowReady <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *MoonrakerSocket) forwardOverflow() {
+	defer close(s.overflowStopped)
+	for {
+		select {
+		case <-s.overflowReady:
+		case <-s.done:
+			return
+		}
+
+		s.lock.Lock()
+		status, eventTime := s.overflow, s.overflowTime
+		// updates arriving while this one is handed over are newer, they queue behind it
+		s.overflow = make(MoonrakerObjects)
+		s.lock.Unlock()
+		if len(status) == 0 {
+			continue
+		}
+
+		params := []any{status}
+		if eventTime != nil {
+			params = append(params, eventTime)
+		}
+		content, err := json.Marshal(params)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case s.Notifications <- JsonRpcMessage{Method: "notify_status_update", Params: content}:
+		case <-s.done:
+			return
+		}
+
+		s.lock.Lock()
+		if len(s.overflow) == 0 {
+			s.overflow = nil
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *MoonrakerSocket) shutdown(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.err = err
+	close(s.done)
+}
+
+func (s *MoonrakerSocket) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+func (s *MoonrakerSocket) Call(ctx context.Context, method string, params any, result any) error {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, moonrakerCallTimeout)
+		defer cancel()
+	}
+
+	s.lock.Lock()
+	s.nextId++
+	id := s.nextId
+	respChan := make(chan JsonRpcMessage, 1)
+	s.pending[id] = respChan
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, id)
+		s.lock.Unlock()
+	}()
+
+	content, err := json.Marshal(JsonRpcRequest{
+		JsonRpc: "2.0",
+		Method:  method,
+		Params:  params,
+		Id:      id,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.conn.Write(ctx, websocket.MessageText, content); err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-respChan:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			return json.Unmarshal(msg.Result, result)
+		}
+		return nil
+	case <-s.done:
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return errors.New("moonraker websocket closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *MoonrakerSocket) Close() {
+	s.shutdown(errors.New("moonraker websocket closed"))
+	s.conn.Close(websocket.StatusNormalClosure, "")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// stand-in moonraker that answers every call only after flooding the client
+// with more status updates than Notifications can hold
+func newFloodingMoonraker(t *testing.T, updates int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx := r.Context()
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			var req JsonRpcRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				return
+			}
+
+			for i := 1; i <= updates; i++ {
+				update := fmt.Sprintf(`{"jsonrpc":"2.0","method":"notify_status_update","params":[{"print_stats":{"print_duration":%d}},%d.5]}`, i, i)
+				if i%2 == 0 {
+					// fields that only change once still have to arrive
+					update = fmt.Sprintf(`{"jsonrpc":"2.0","method":"notify_status_update","params":[{"print_stats":{"print_duration":%d},"extruder":{"target":%d}},%d.5]}`, i, i, i)
+				}
+				if err := conn.Write(ctx, websocket.MessageText, []byte(update)); err != nil {
+					return
+				}
+			}
+			conn.Write(ctx, websocket.MessageText, []byte(`{"jsonrpc":"2.0","method":"notify_gcode_response","params":["ok"]}`))
+			conn.Write(ctx, websocket.MessageText, []byte(fmt.Sprintf(`{"jsonrpc":"2.0","result":"ok","id":%d}`, req.Id)))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMoonrakerSocketCallWhileNotificationsBackUp(t *testing.T) {
+	const updates = 1000
+	srv := newFloodingMoonraker(t, updates)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	socket, err := dialMoonrakerSocket(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	// nothing drains Notifications while the call is waiting, like the poller
+	// calling from its notification loop
+	var result string
+	if err := socket.Call(ctx, "server.info", nil, &result); err != nil {
+		t.Fatalf("call blocked behind notifications: %v", err)
+	}
+	if result != "ok" {
+		t.Fatalf("result = %q", result)
+	}
+
+	objects := make(MoonrakerObjects)
+	for objects["print_stats"] == nil || string(objects["print_stats"]["print_duration"]) != fmt.Sprint(updates) {
+		select {
+		case n := <-socket.Notifications:
+			if n.Method != "notify_status_update" {
+				continue
+			}
+			var params []json.RawMessage
+			var status MoonrakerObjects
+			if err := json.Unmarshal(n.Params, &params); err != nil || len(params) == 0 {
+				t.Fatalf("bad params %s", n.Params)
+			}
+			if err := json.Unmarshal(params[0], &status); err != nil {
+				t.Fatal(err)
+			}
+			objects.merge(status)
+		case <-ctx.Done():
+			t.Fatalf("latest status never arrived, have %v", objects)
+		}
+	}
+
+	if got := string(objects["extruder"]["target"]); got != fmt.Sprint(updates) {
+		t.Errorf("extruder target = %s, want %d", got, updates)
+	}
+}
+
+func TestMoonrakerSocketCallHonorsDeadline(t *testing.T) {
+	// accepts the connection but never answers
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			if _, _, err := conn.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	socket, err := dialMoonrakerSocket(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := socket.Call(ctx, "server.info", nil, nil); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
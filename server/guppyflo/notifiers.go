@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	NotifierNtfy     = "ntfy"
+	NotifierGotify   = "gotify"
+	NotifierDiscord  = "discord"
+	NotifierTelegram = "telegram"
+	NotifierPushover = "pushover"
+)
+
+const (
+	defaultNtfyUrl     = "https://ntfy.sh"
+	defaultTelegramUrl = "https://api.telegram.org"
+	defaultPushoverUrl = "https://api.pushover.net/1/messages.json"
+
+	defaultTitleTemplate   = `{{.Printer.Name}}: {{eventTitle .Type}}`
+	defaultMessageTemplate = `{{if .Alert}}{{.Alert.Message}}{{else}}{{with .Job}}{{.Filename}}` +
+		`{{if .PrintDuration}} after {{duration .PrintDuration}}{{end}}` +
+		`{{if .FilamentUsed}}, {{meters .FilamentUsed}} filament{{end}}` +
+		`{{if .Message}}: {{.Message}}{{end}}` +
+		`{{else}}Printer is {{.State}}{{end}}{{end}}`
+)
+
+var notifierClient = http.Client{Timeout: 10 * time.Second}
+
+type Notification struct {
+	Title   string
+	Message string
+	Event   PrinterEvent
+}
+
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+var eventTitles = map[string]string{
+	EventPrintStarted:   "print started",
+	EventPrintComplete:  "print complete",
+	EventPrintError:     "print failed",
+	EventPrintCancelled: "print cancelled",
+	EventPaused:         "print paused",
+	EventOffline:        "offline",
+	EventOnline:         "back online",
+	EventAlert:          "watchdog alert",
+}
+
+var templateFuncs = template.FuncMap{
+	"eventTitle": func(eventType string) string {
+		if title, exists := eventTitles[eventType]; exists {
+			return title
+		}
+		return eventType
+	},
+	"duration": func(seconds float64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+	"meters": func(mm float64) string {
+		return fmt.Sprintf("%.2fm", mm/1000)
+	},
+	"percent": func(progress float64) string {
+		return fmt.Sprintf("%.0f%%", progress*100)
+	},
+}
+
+func renderTemplate(text string, e PrinterEvent) (string, error) {
+	t, err := template.New("notification").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, e); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// templates are picked per event first, then the notifier's own, then the defaults
+func buildNotification(c GTNotifierConfig, e PrinterEvent) (Notification, error) {
+	titleTemplate, messageTemplate := defaultTitleTemplate, defaultMessageTemplate
+	if c.Title != "" {
+		titleTemplate = c.Title
+	}
+	if c.Message != "" {
+		messageTemplate = c.Message
+	}
+	if t, exists := c.Templates[e.Type]; exists {
+		if t.Title != "" {
+			titleTemplate = t.Title
+		}
+		if t.Message != "" {
+			messageTemplate = t.Message
+		}
+	}
+
+	title, err := renderTemplate(titleTemplate, e)
+	if err != nil {
+		return Notification{}, err
+	}
+	message, err := renderTemplate(messageTemplate, e)
+	if err != nil {
+		return Notification{}, err
+	}
+	return Notification{Title: title, Message: message, Event: e}, nil
+}
+
+func newNotifier(c GTNotifierConfig) (Notifier, error) {
+	switch c.Type {
+	case NotifierNtfy:
+		if c.Topic == "" {
+			return nil, fmt.Errorf("ntfy notifier needs a topic")
+		}
+		return &NtfyNotifier{config: c}, nil
+	case NotifierGotify:
+		if c.Url == "" || c.Token == "" {
+			return nil, fmt.Errorf("gotify notifier needs a url and an app token")
+		}
+		return &GotifyNotifier{config: c}, nil
+	case NotifierDiscord:
+		if c.Url == "" {
+			return nil, fmt.Errorf("discord notifier needs a webhook url")
+		}
+		return &DiscordNotifier{config: c}, nil
+	case NotifierTelegram:
+		if c.Token == "" || c.ChatId == "" {
+			return nil, fmt.Errorf("telegram notifier needs a bot token and a chat id")
+		}
+		return &TelegramNotifier{config: c}, nil
+	case NotifierPushover:
+		if c.Token == "" || c.User == "" {
+			return nil, fmt.Errorf("pushover notifier needs an app token and a user key")
+		}
+		return &PushoverNotifier{config: c}, nil
+	case NotifierEmail:
+		if c.Smtp == nil || c.Smtp.Host == "" {
+			return nil, fmt.Errorf("email notifier needs an smtp host")
+		}
+		if s := c.Smtp.Security; s != "" && s != SmtpStartTls && s != SmtpTls && s != SmtpNone {
+			return nil, fmt.Errorf("unknown smtp security %q", s)
+		}
+		return &EmailNotifier{config: c}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+}
+
+func notifierName(c GTNotifierConfig) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+func deliverNotifications(e PrinterEvent) {
+	GTConfigLock.RLock()
+	notifiers := slices.Clone(gtconfig.Notifiers)
+	GTConfigLock.RUnlock()
+
+	for _, c := range notifiers {
+		if !eventMatches(e, c.Events, c.Printers) {
+			continue
+		}
+
+		notifier, err := newNotifier(c)
+		if err != nil {
+			log.Println("Invalid notifier", notifierName(c), err)
+			continue
+		}
+
+		n, err := buildNotification(c, e)
+		if err != nil {
+			log.Println("Failed to render notification for", notifierName(c), err)
+			continue
+		}
+
+		go func(name string) {
+			if err := notifier.Notify(n); err != nil {
+				log.Println("Failed to send", e.Type, "notification via", name, err)
+			}
+		}(notifierName(c))
+	}
+}
+
+// url errors quote the whole url, which carries the bot token for telegram
+func withoutUrl(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// posts and treats anything but 2xx as an error, including some of the body
+// since providers explain what's wrong there
+func notifierPost(req *http.Request) error {
+	req.Header.Set("User-Agent", "GuppyFLO")
+	resp, err := notifierClient.Do(req)
+	if err != nil {
+		return withoutUrl(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func notifierPostJson(endpoint string, header http.Header, payload any) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(content))
+	if err != nil {
+		return withoutUrl(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return notifierPost(req)
+}
+
+func baseUrl(configured string, fallback string) string {
+	if configured == "" {
+		return fallback
+	}
+	return strings.TrimSuffix(configured, "/")
+}
+
+type NtfyNotifier struct {
+	config GTNotifierConfig
+}
+
+func (n *NtfyNotifier) Notify(msg Notification) error {
+	endpoint := baseUrl(n.config.Url, defaultNtfyUrl) + "/" + url.PathEscape(n.config.Topic)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(msg.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", msg.Title)
+	req.Header.Set("Tags", msg.Event.Type)
+	if msg.Event.Type == EventPrintError || msg.Event.Type == EventOffline {
+		req.Header.Set("Priority", "high")
+	}
+	if n.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.config.Token)
+	}
+	return notifierPost(req)
+}
+
+type GotifyNotifier struct {
+	config GTNotifierConfig
+}
+
+func (n *GotifyNotifier) Notify(msg Notification) error {
+	priority := 5
+	if msg.Event.Type == EventPrintError || msg.Event.Type == EventOffline {
+		priority = 8
+	}
+
+	header := make(http.Header)
+	header.Set("X-Gotify-Key", n.config.Token)
+	return notifierPostJson(baseUrl(n.config.Url, "")+"/message", header, map[string]any{
+		"title":    msg.Title,
+		"message":  msg.Message,
+		"priority": priority,
+	})
+}
+
+type DiscordNotifier struct {
+	config GTNotifierConfig
+}
+
+func (n *DiscordNotifier) Notify(msg Notification) error {
+	color := 0x3b82f6
+	switch msg.Event.Type {
+	case EventPrintComplete, EventOnline:
+		color = 0x22c55e
+	case EventPrintError, EventOffline:
+		color = 0xef4444
+	}
+
+	return notifierPostJson(n.config.Url, nil, map[string]any{
+		"username": "GuppyFLO",
+		"embeds": []map[string]any{{
+			"title":       msg.Title,
+			"description": msg.Message,
+			"color":       color,
+			"timestamp":   time.Unix(msg.Event.Time, 0).UTC().Format(time.RFC3339),
+		}},
+	})
+}
+
+type TelegramNotifier struct {
+	config GTNotifierConfig
+}
+
+func (n *TelegramNotifier) Notify(msg Notification) error {
+	endpoint := baseUrl(n.config.Url, defaultTelegramUrl) + "/bot" + n.config.Token + "/sendMessage"
+	return notifierPostJson(endpoint, nil, map[string]any{
+		"chat_id": n.config.ChatId,
+		"text":    msg.Title + "\n" + msg.Message,
+	})
+}
+
+type PushoverNotifier struct {
+	config GTNotifierConfig
+}
+
+func (n *PushoverNotifier) Notify(msg Notification) error {
+	form := url.Values{
+		"token":   {n.config.Token},
+		"user":    {n.config.User},
+		"title":   {msg.Title},
+		"message": {msg.Message},
+	}
+	if msg.Event.Type == EventPrintError || msg.Event.Type == EventOffline {
+		form.Set("priority", "1")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, baseUrl(n.config.Url, defaultPushoverUrl), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return notifierPost(req)
+}
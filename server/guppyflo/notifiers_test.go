@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type capturedRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// stand-in for a provider's api, answers every request with status and body
+func newProviderServer(t *testing.T, status int, body string) (*httptest.Server, chan capturedRequest) {
+	t.Helper()
+	requests := make(chan capturedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := io.ReadAll(r.Body)
+		requests <- capturedRequest{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: string(content)}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func testNotification(eventType string) Notification {
+	return Notification{
+		Title:   "Voron: print failed",
+		Message: "benchy.gcode: MCU shutdown",
+		Event: PrinterEvent{
+			Type:    eventType,
+			Time:    1700000000,
+			Printer: EventPrinter{Id: "p1", Name: "Voron"},
+		},
+	}
+}
+
+func sendTestNotification(t *testing.T, c GTNotifierConfig, msg Notification) error {
+	t.Helper()
+	notifier, err := newNotifier(c)
+	if err != nil {
+		t.Fatalf("newNotifier: %v", err)
+	}
+	return notifier.Notify(msg)
+}
+
+func decodeJsonBody(t *testing.T, body string) map[string]any {
+	t.Helper()
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		t.Fatalf("body isn't json: %v: %s", err, body)
+	}
+	return payload
+}
+
+func TestNtfyNotifier(t *testing.T) {
+	srv, requests := newProviderServer(t, http.StatusOK, "")
+	err := sendTestNotification(t, GTNotifierConfig{Type: NotifierNtfy, Url: srv.URL + "/", Topic: "my printers", Token: "tk"},
+		testNotification(EventPrintError))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.method != http.MethodPost || r.path != "/my printers" {
+		t.Errorf("got %s %s, want POST /my printers", r.method, r.path)
+	}
+	if r.body != "benchy.gcode: MCU shutdown" {
+		t.Errorf("body = %q", r.body)
+	}
+	want := map[string]string{
+		"Title":         "Voron: print failed",
+		"Tags":          EventPrintError,
+		"Priority":      "high",
+		"Authorization": "Bearer tk",
+	}
+	for k, v := range want {
+		if got := r.header.Get(k); got != v {
+			t.Errorf("header %s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestNtfyNotifierDefaultPriority(t *testing.T) {
+	srv, requests := newProviderServer(t, http.StatusOK, "")
+	err := sendTestNotification(t, GTNotifierConfig{Type: NotifierNtfy, Url: srv.URL, Topic: "t"},
+		testNotification(EventPrintComplete))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.header.Get("Priority") != "" || r.header.Get("Authorization") != "" {
+		t.Errorf("unexpected priority or auth header: %v", r.header)
+	}
+}
+
+func TestGotifyNotifier(t *testing.T) {
+	srv, requests := newProviderServer(t, http.StatusOK, "{}")
+	err := sendTestNotification(t, GTNotifierConfig{Type: NotifierGotify, Url: srv.URL, Token: "app-token"},
+		testNotification(EventOffline))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.path != "/message" {
+		t.Errorf("path = %s, want /message", r.path)
+	}
+	if got := r.header.Get("X-Gotify-Key"); got != "app-token" {
+		t.Errorf("X-Gotify-Key = %q", got)
+	}
+	if got := r.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	payload := decodeJsonBody(t, r.body)
+	if payload["title"] != "Voron: print failed" || payload["message"] != "benchy.gcode: MCU shutdown" || payload["priority"] != 8.0 {
+		t.Errorf("payload = %v", payload)
+	}
+}
+
+func TestDiscordNotifier(t *testing.T) {
+	srv, requests := newProviderServer(t, http.StatusNoContent, "")
+	err := sendTestNotification(t, GTNotifierConfig{Type: NotifierDiscord, Url: srv.URL + "/api/webhooks/1/abc"},
+		testNotification(EventPrintComplete))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.path != "/api/webhooks/1/abc" {
+		t.Errorf("path = %s", r.path)
+	}
+
+	var payload struct {
+		Username string `json:"username"`
+		Embeds   []struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+			Color       int    `json:"color"`
+			Timestamp   string `json:"timestamp"`
+		} `json:"embeds"`
+	}
+	if err := json.Unmarshal([]byte(r.body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Username != "GuppyFLO" || len(payload.Embeds) != 1 {
+		t.Fatalf("payload = %+v", payload)
+	}
+	embed := payload.Embeds[0]
+	if embed.Title != "Voron: print failed" || embed.Description != "benchy.gcode: MCU shutdown" {
+		t.Errorf("embed = %+v", embed)
+	}
+	if embed.Color != 0x22c55e {
+		t.Errorf("color = %#x, want green for print_complete", embed.Color)
+	}
+	if embed.Timestamp != "2023-11-14T22:13:20Z" {
+		t.Errorf("timestamp = %s", embed.Timestamp)
+	}
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	srv, requests := newProviderServer(t, http.StatusOK, `{"ok":true}`)
+	err := sendTestNotification(t, GTNotifierConfig{Type: NotifierTelegram, Url: srv.URL, Token: "123:secret", ChatId: "-42"},
+		testNotification(EventPrintError))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.path != "/bot123:secret/sendMessage" {
+		t.Errorf("path = %s", r.path)
+	}
+	payload := decodeJsonBody(t, r.body)
+	if payload["chat_id"] != "-42" || payload["text"] != "Voron: print failed\nbenchy.gcode: MCU shutdown" {
+		t.Errorf("payload = %v", payload)
+	}
+}
+
+func TestTelegramNotifierErrorHidesToken(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	err := sendTestNotification(t, GTNotifierConfig{Type: NotifierTelegram, Url: srv.URL, Token: "123:secret", ChatId: "-42"},
+		testNotification(EventPrintError))
+	if err == nil {
+		t.Fatal("expected an error from a closed server")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error leaks the bot token: %v", err)
+	}
+}
+
+func TestPushoverNotifier(t *testing.T) {
+	srv, requests := newProviderServer(t, http.StatusOK, `{"status":1}`)
+	err := sendTestNotification(t, GTNotifierConfig{Type: NotifierPushover, Url: srv.URL + "/1/messages.json", Token: "app", User: "user"},
+		testNotification(EventPrintError))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.path != "/1/messages.json" {
+		t.Errorf("path = %s", r.path)
+	}
+	if got := r.header.Get("Content-Type"); got != "application/x-www-form-urlencoded" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	form, err := url.ParseQuery(r.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"token":    "app",
+		"user":     "user",
+		"title":    "Voron: print failed",
+		"message":  "benchy.gcode: MCU shutdown",
+		"priority": "1",
+	}
+	for k, v := range want {
+		if got := form.Get(k); got != v {
+			t.Errorf("form %s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestNotifierNon2xx(t *testing.T) {
+	configs := map[string]func(url string) GTNotifierConfig{
+		NotifierNtfy: func(u string) GTNotifierConfig {
+			return GTNotifierConfig{Type: NotifierNtfy, Url: u, Topic: "t"}
+		},
+		NotifierGotify: func(u string) GTNotifierConfig {
+			return GTNotifierConfig{Type: NotifierGotify, Url: u, Token: "t"}
+		},
+		NotifierDiscord: func(u string) GTNotifierConfig {
+			return GTNotifierConfig{Type: NotifierDiscord, Url: u}
+		},
+		NotifierTelegram: func(u string) GTNotifierConfig {
+			return GTNotifierConfig{Type: NotifierTelegram, Url: u, Token: "t", ChatId: "1"}
+		},
+		NotifierPushover: func(u string) GTNotifierConfig {
+			return GTNotifierConfig{Type: NotifierPushover, Url: u, Token: "t", User: "u"}
+		},
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			srv, _ := newProviderServer(t, http.StatusBadRequest, "  invalid token\n")
+			err := sendTestNotification(t, config(srv.URL), testNotification(EventPrintComplete))
+			if err == nil {
+				t.Fatal("expected an error for a 400 response")
+			}
+			if !strings.Contains(err.Error(), "400") || !strings.HasSuffix(err.Error(), ": invalid token") {
+				t.Errorf("error = %q, want the status and the trimmed body", err)
+			}
+		})
+	}
+}
+
+func TestNewNotifierValidation(t *testing.T) {
+	invalid := []GTNotifierConfig{
+		{Type: NotifierNtfy},
+		{Type: NotifierGotify, Url: "http://gotify"},
+		{Type: NotifierDiscord},
+		{Type: NotifierTelegram, Token: "t"},
+		{Type: NotifierPushover, User: "u"},
+		{Type: "sms"},
+	}
+	for _, c := range invalid {
+		if _, err := newNotifier(c); err == nil {
+			t.Errorf("newNotifier(%+v) accepted an incomplete config", c)
+		}
+	}
+}
+
+func TestBuildNotification(t *testing.T) {
+	failed := PrinterEvent{
+		Type:    EventPrintError,
+		Printer: EventPrinter{Id: "p1", Name: "Voron"},
+		State:   "error",
+		Job: &EventJob{
+			Filename:      "benchy.gcode",
+			Progress:      0.42,
+			PrintDuration: 3725,
+			FilamentUsed:  1234,
+			Message:       "MCU shutdown",
+		},
+	}
+	offline := PrinterEvent{
+		Type:    EventOffline,
+		Printer: EventPrinter{Id: "p1", Name: "Voron"},
+		State:   "offline",
+	}
+	alert := PrinterEvent{
+		Type:    EventAlert,
+		Printer: EventPrinter{Id: "p1", Name: "Voron"},
+		Alert:   &PrinterAlert{Message: "extruder is at 300.0°C with its heater off"},
+	}
+
+	tests := []struct {
+		name        string
+		config      GTNotifierConfig
+		event       PrinterEvent
+		wantTitle   string
+		wantMessage string
+	}{
+		{
+			name:        "default job",
+			event:       failed,
+			wantTitle:   "Voron: print failed",
+			wantMessage: "benchy.gcode after 1h2m5s, 1.23m filament: MCU shutdown",
+		},
+		{
+			name:        "default without job",
+			event:       offline,
+			wantTitle:   "Voron: offline",
+			wantMessage: "Printer is offline",
+		},
+		{
+			name:        "default alert",
+			event:       alert,
+			wantTitle:   "Voron: watchdog alert",
+			wantMessage: "extruder is at 300.0°C with its heater off",
+		},
+		{
+			name:        "notifier templates",
+			config:      GTNotifierConfig{Title: "{{.Printer.Id}}", Message: "{{.Job.Filename}} at {{percent .Job.Progress}}"},
+			event:       failed,
+			wantTitle:   "p1",
+			wantMessage: "benchy.gcode at 42%",
+		},
+		{
+			name: "event template wins",
+			config: GTNotifierConfig{
+				Message: "generic",
+				Templates: map[string]GTMessageTemplate{
+					EventPrintError: {Message: "{{.Job.Filename}} failed: {{.Job.Message}}"},
+				},
+			},
+			event:       failed,
+			wantTitle:   "Voron: print failed",
+			wantMessage: "benchy.gcode failed: MCU shutdown",
+		},
+		{
+			name: "other event templates are ignored",
+			config: GTNotifierConfig{
+				Templates: map[string]GTMessageTemplate{EventPrintComplete: {Title: "done"}},
+			},
+			event:       offline,
+			wantTitle:   "Voron: offline",
+			wantMessage: "Printer is offline",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := buildNotification(tt.config, tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.Title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", n.Title, tt.wantTitle)
+			}
+			if n.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", n.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestBuildNotificationTemplateErrors(t *testing.T) {
+	e := PrinterEvent{Type: EventOffline, Printer: EventPrinter{Name: "Voron"}}
+	for _, c := range []GTNotifierConfig{
+		{Title: "{{.Printer.Name"},
+		{Message: "{{unknownFunc .Type}}"},
+		// offline events have no job
+		{Message: "{{.Job.Filename}}"},
+	} {
+		if _, err := buildNotification(c, e); err == nil {
+			t.Errorf("buildNotification(%+v) should fail", c)
+		}
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	printingPollInterval   = 3 * time.Second
+	idlePollInterval       = 10 * time.Second
+	maxOfflinePollInterval = 5 * time.Minute
+	websocketRetryInterval = 30 * time.Second
+	klippyRetryInterval    = 10 * time.Second
+	maxFailedAttempts      = 3
+	// proxied ui requests come in bursts, one re-poll per burst is plenty
+	minWakeInterval = 2 * time.Second
+	// moonraker may still be scanning a file that was just uploaded and started
+	metadataRetryInterval    = 5 * time.Second
+	maxMetadataRetryInterval = 5 * time.Minute
+)
+
+var printerObjects = []string{"print_stats", "virtual_sdcard", "extruder", "heater_bed", "webhooks"}
+
+// metadata of the file being printed. it's fetched in the background so a slow
+// moonraker never holds up status updates, and only kept once the fetch worked.
+type metadataFetch struct {
+	lock     sync.Mutex
+	filename string
+	metadata *GcodeMetadata
+	fetching bool
+	failures int
+	retryAt  time.Time
+}
+
+type printerPoller struct {
+	ctx            context.Context
+	printer        GTPrinterConfig
+	printerId      string
+	quit           chan bool
+	reload         chan bool
+	wake           chan bool
+	objects        MoonrakerObjects
+	customObjects  []string
+	extruders      []string
+	metadata       metadataFetch
+	klippyState    string
+	state          string
+	failedAttempts int
+	lastPoll       time.Time
+}
+
+// pollPrinter keeps a moonraker websocket subscription to the printer's klipper
+// objects and falls back to http polling whenever the websocket can't be used.
+func pollPrinter(p GTPrinterConfig, quit chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	pp := &printerPoller{
+		ctx:       ctx,
+		printer:   p,
+		printerId: getPrinterId(p),
+		quit:      quit,
+		reload:    make(chan bool, 1),
+		wake:      make(chan bool, 1),
+		objects:   make(MoonrakerObjects),
+	}
+
+	PrintersMapLock.Lock()
+	PrinterReloadChannels[pp.printerId] = pp.reload
+	PrinterWakeChannels[pp.printerId] = pp.wake
+	PrintersMapLock.Unlock()
+
+	defer func() {
+		PrintersMapLock.Lock()
+		if PrinterReloadChannels[pp.printerId] == pp.reload {
+			delete(PrinterReloadChannels, pp.printerId)
+		}
+		if PrinterWakeChannels[pp.printerId] == pp.wake {
+			delete(PrinterWakeChannels, pp.printerId)
+		}
+		PrintersMapLock.Unlock()
+	}()
+
+	log.Println("Connecting to printer at:", moonrakerBaseUrl(p))
+	for ctx.Err() == nil {
+		err := pp.subscribe()
+		if ctx.Err() != nil {
+			break
+		}
+
+		PollFailuresMetric.Inc(pp.printerId, "websocket")
+		recordPollFailure(pp.printerId, "websocket", err)
+		log.Println("Moonraker websocket failed for printer", moonrakerBaseUrl(p), err,
+			"- falling back to HTTP polling")
+		pp.poll(websocketRetryInterval)
+	}
+
+	log.Println("Stop polling for printer", moonrakerBaseUrl(p))
+}
+
+func (pp *printerPoller) subscribe() error {
+	p := pp.config()
+	header, err := moonrakerAuthHeader(p)
+	if err != nil {
+		return err
+	}
+
+	transport, err := getMoonrakerTransport(p)
+	if err != nil {
+		return err
+	}
+
+	socket, err := dialMoonrakerSocket(pp.ctx, moonrakerWebsocketUrl(p), header, transport)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	start := time.Now()
+	err = socket.Call(pp.ctx, "server.connection.identify", moonrakerIdentity(p, header), nil)
+	if err != nil {
+		return err
+	}
+	recordPollSuccess(pp.printerId, "websocket", time.Since(start))
+
+	if err := pp.subscribeObjects(socket); err != nil {
+		return err
+	}
+
+	// notify_klippy_ready never comes for a klippy stuck in startup or error.
+	// while klippy is fine the ticker pings moonraker to measure latency instead.
+	heartbeat := time.NewTicker(klippyRetryInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-pp.ctx.Done():
+			return pp.ctx.Err()
+		case <-heartbeat.C:
+			if pp.klippyState == "" {
+				start := time.Now()
+				var info MoonrakerServerInfo
+				if err := socket.Call(pp.ctx, "server.info", nil, &info); err != nil {
+					return err
+				}
+				recordPollSuccess(pp.printerId, "websocket", time.Since(start))
+				continue
+			}
+			if err := pp.subscribeObjects(socket); err != nil {
+				return err
+			}
+		case n, ok := <-socket.Notifications:
+			if !ok {
+				return socket.Err()
+			}
+
+			switch n.Method {
+			case "notify_status_update":
+				var params []json.RawMessage
+				if err := json.Unmarshal(n.Params, &params); err != nil || len(params) == 0 {
+					continue
+				}
+
+				var status MoonrakerObjects
+				if err := json.Unmarshal(params[0], &status); err != nil {
+					log.Println("error decoding status update", err)
+					continue
+				}
+				pp.objects.merge(status)
+				pp.publish()
+				recordPollSuccess(pp.printerId, "websocket", 0)
+			case "notify_klippy_ready":
+				// klippy restarted, subscriptions have to be renewed
+				if err := pp.subscribeObjects(socket); err != nil {
+					return err
+				}
+			case "notify_klippy_shutdown":
+				// webhooks carries the shutdown reason in the next status update
+				pp.klippyState = "shutdown"
+				pp.publish()
+			case "notify_klippy_disconnected":
+				pp.klippyState = "disconnected"
+				pp.objects = make(MoonrakerObjects)
+				pp.publish()
+			}
+		case <-pp.reload:
+			// printer config changed, a new subscription replaces the old one
+			if err := pp.subscribeObjects(socket); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// signals the printer's poller to pick up config changes, callers must hold PrintersMapLock
+func reloadPrinterPoller(printerId string) {
+	reload, exists := PrinterReloadChannels[printerId]
+	if !exists {
+		return
+	}
+	select {
+	case reload <- true:
+	default:
+	}
+}
+
+// asks the printer's poller to poll right away, e.g. because someone opened its ui.
+// callers must hold PrintersMapLock (read lock is enough).
+func wakePrinterPoller(printerId string) {
+	wake, exists := PrinterWakeChannels[printerId]
+	if !exists {
+		return
+	}
+	select {
+	case wake <- true:
+	default:
+	}
+}
+
+// latest printer config, it can change through the printers api while polling
+func (pp *printerPoller) config() GTPrinterConfig {
+	PrintersMapLock.RLock()
+	defer PrintersMapLock.RUnlock()
+	p, exists := Printers[pp.printerId]
+	if !exists {
+		return pp.printer
+	}
+	return p.PrinterInfo
+}
+
+// built-in objects, discovered extruders and any extra klipper objects configured
+// for the printer. a nil field list subscribes to every field of the object.
+func (pp *printerPoller) subscribedObjects() map[string][]string {
+	configured := pp.config().Objects
+
+	objects := make(map[string][]string)
+	for _, o := range printerObjects {
+		objects[o] = nil
+	}
+	for _, e := range pp.extruders {
+		objects[e] = nil
+	}
+	if len(pp.extruders) > 1 {
+		// only needed to tell which tool is active
+		objects["toolhead"] = []string{"extruder"}
+	}
+
+	pp.customObjects = pp.customObjects[:0]
+	for _, o := range configured {
+		o = strings.TrimSpace(o)
+		if o == "" || slices.Contains(printerObjects, o) || slices.Contains(pp.customObjects, o) {
+			continue
+		}
+		objects[o] = nil
+		pp.customObjects = append(pp.customObjects, o)
+	}
+	return objects
+}
+
+// keeps extruder, extruder1...extruderN from the printer's object list, in tool order
+func findExtruders(objects []string) []string {
+	extruders := make([]string, 0)
+	for _, o := range objects {
+		if o == "extruder" {
+			extruders = append(extruders, o)
+			continue
+		}
+		if n, found := strings.CutPrefix(o, "extruder"); found {
+			if _, err := strconv.Atoi(n); err == nil {
+				extruders = append(extruders, o)
+			}
+		}
+	}
+
+	slices.SortFunc(extruders, func(a, b string) int {
+		na, _ := strconv.Atoi(strings.TrimPrefix(a, "extruder"))
+		nb, _ := strconv.Atoi(strings.TrimPrefix(b, "extruder"))
+		return na - nb
+	})
+	return extruders
+}
+
+func (pp *printerPoller) discoverExtruders(socket *MoonrakerSocket) error {
+	var result struct {
+		Objects []string `json:"objects"`
+	}
+	if err := socket.Call(pp.ctx, "printer.objects.list", nil, &result); err != nil {
+		return err
+	}
+	pp.extruders = findExtruders(result.Objects)
+	return nil
+}
+
+func (pp *printerPoller) discoverExtrudersHttp() error {
+	var result struct {
+		Objects []string `json:"objects"`
+	}
+	if err := moonrakerGetResult(pp.config(), "/printer/objects/list", &result); err != nil {
+		return err
+	}
+	pp.extruders = findExtruders(result.Objects)
+	return nil
+}
+
+// subscribeObjects returns an error only when the websocket itself fails.
+// klippy not being ready is not fatal, moonraker sends notify_klippy_ready once it is.
+func (pp *printerPoller) subscribeObjects(socket *MoonrakerSocket) error {
+	var rpcErr *JsonRpcError
+	err := pp.discoverExtruders(socket)
+	if errors.As(err, &rpcErr) {
+		log.Println("Failed to list printer objects", moonrakerBaseUrl(pp.config()), err)
+		return pp.updateKlippyState(socket)
+	}
+	if err != nil {
+		return err
+	}
+
+	var result MoonrakerSubscribeResult
+	err = socket.Call(pp.ctx, "printer.objects.subscribe", map[string]any{
+		"objects": pp.subscribedObjects(),
+	}, &result)
+
+	if errors.As(err, &rpcErr) {
+		log.Println("Failed to subscribe to printer objects", moonrakerBaseUrl(pp.config()), err)
+		return pp.updateKlippyState(socket)
+	}
+	if err != nil {
+		return err
+	}
+
+	pp.klippyState = ""
+	pp.objects = make(MoonrakerObjects)
+	pp.objects.merge(result.Status)
+	pp.publish()
+	return nil
+}
+
+// moonraker is up but klippy can't be queried, report why
+func (pp *printerPoller) updateKlippyState(socket *MoonrakerSocket) error {
+	var info MoonrakerServerInfo
+	err := socket.Call(pp.ctx, "server.info", nil, &info)
+	var rpcErr *JsonRpcError
+	if err != nil && !errors.As(err, &rpcErr) {
+		return err
+	}
+
+	pp.klippyState = info.KlippyState
+	pp.objects = make(MoonrakerObjects)
+	pp.publish()
+	return nil
+}
+
+func (pp *printerPoller) serverInfoHttp() (*MoonrakerServerInfo, error) {
+	var info MoonrakerServerInfo
+	if err := moonrakerGetResult(pp.config(), "/server/info", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// next http poll delay: fast while printing, slower when idle and exponential
+// backoff once the printer is considered offline
+func (pp *printerPoller) pollInterval() time.Duration {
+	p := pp.config()
+	printing, idle, offlineMax := printingPollInterval, idlePollInterval, maxOfflinePollInterval
+	if p.PollIntervals != nil {
+		if p.PollIntervals.Printing > 0 {
+			printing = time.Duration(p.PollIntervals.Printing) * time.Second
+		}
+		if p.PollIntervals.Idle > 0 {
+			idle = time.Duration(p.PollIntervals.Idle) * time.Second
+		}
+		if p.PollIntervals.OfflineMax > 0 {
+			offlineMax = time.Duration(p.PollIntervals.OfflineMax) * time.Second
+		}
+	}
+
+	if pp.failedAttempts >= maxFailedAttempts {
+		backoff := idle << min(pp.failedAttempts-maxFailedAttempts, 16)
+		return min(backoff, max(offlineMax, idle))
+	}
+
+	switch pp.state {
+	case "printing", "paused":
+		return printing
+	case "":
+		// not polled yet or just failed, find out quickly
+		return min(printing, idle)
+	}
+	return idle
+}
+
+// polls over http until d has passed. an offline printer gets polled once per
+// backoff interval, and a printer coming back ends the fallback right away so the
+// websocket is retried.
+func (pp *printerPoller) poll(d time.Duration) {
+	// rediscover tools, klipper may have restarted with a different config
+	pp.extruders = nil
+	deadline := time.Now().Add(d)
+
+	timer := time.NewTimer(pp.pollInterval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-pp.ctx.Done():
+			return
+		case <-pp.wake:
+			if time.Since(pp.lastPoll) < minWakeInterval {
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+
+		wasOffline := pp.failedAttempts >= maxFailedAttempts
+		pp.pollOnce()
+		if time.Now().After(deadline) || (wasOffline && pp.failedAttempts == 0) {
+			return
+		}
+		timer.Reset(pp.pollInterval())
+	}
+}
+
+func (pp *printerPoller) pollOnce() {
+	pp.lastPoll = time.Now()
+	start := time.Now()
+	info, err := pp.serverInfoHttp()
+	latency := time.Since(start)
+	if err != nil {
+		PollFailuresMetric.Inc(pp.printerId, "http")
+		recordPollFailure(pp.printerId, "http", err)
+		pp.failedAttempts++
+		if pp.failedAttempts >= maxFailedAttempts {
+			pp.state = "offline"
+			pp.send(PrinterInfoStatsPair{
+				PrinterId: pp.printerId,
+				Stats: PrinterStats{
+					State: "offline",
+				},
+				SDCard: VirtualSDCard{},
+			})
+		}
+		return
+	}
+	pp.failedAttempts = 0
+
+	if !info.KlippyConnected {
+		pp.klippyState = info.KlippyState
+		pp.objects = make(MoonrakerObjects)
+		pp.publish()
+		recordPollSuccess(pp.printerId, "http", latency)
+		return
+	}
+	pp.klippyState = ""
+
+	if pp.extruders == nil {
+		// retried on the next poll when it fails
+		pp.discoverExtrudersHttp()
+	}
+
+	query := make([]string, 0)
+	for name, fields := range pp.subscribedObjects() {
+		if fields == nil {
+			query = append(query, url.QueryEscape(name))
+		} else {
+			query = append(query, url.QueryEscape(name)+"="+url.QueryEscape(strings.Join(fields, ",")))
+		}
+	}
+	slices.Sort(query)
+
+	queryPath := "/printer/objects/query?" + strings.Join(query, "&")
+	resp, err := moonrakerRequest(pp.config(), http.MethodGet, queryPath, nil, "")
+	if err != nil {
+		PollFailuresMetric.Inc(pp.printerId, "http")
+		recordPollFailure(pp.printerId, "http", err)
+		log.Println("Failed to query printer objects", moonrakerBaseUrl(pp.config()), err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		PollFailuresMetric.Inc(pp.printerId, "http")
+		recordPollFailure(pp.printerId, "http", &MoonrakerStatusError{Path: queryPath, Status: resp.Status, StatusCode: resp.StatusCode})
+		log.Println("Failed to query printer objects", moonrakerBaseUrl(pp.config()), resp.Status)
+		return
+	}
+
+	var moonrakerResult MoonrakerPrinterStats
+	err = json.NewDecoder(resp.Body).Decode(&moonrakerResult)
+	if err != nil {
+		recordPollFailure(pp.printerId, "http", err)
+		log.Println("error decoding pstats", err)
+	} else {
+		// queries return every requested object in full
+		pp.objects = make(MoonrakerObjects)
+		recordPollSuccess(pp.printerId, "http", latency)
+	}
+
+	pp.objects.merge(moonrakerResult.Result.Status)
+	pp.publish()
+}
+
+func (pp *printerPoller) publish() {
+	var status MoonrakerPrinterStatus
+	if err := pp.objects.decode(&status); err != nil {
+		log.Println("error decoding pstats", err)
+	}
+
+	pp.state = status.Stats.State
+
+	// webhooks is authoritative whenever klippy is connected
+	klippyState, stateMessage := pp.klippyState, ""
+	if _, exists := pp.objects["webhooks"]; exists {
+		klippyState = status.Webhooks.State
+		stateMessage = status.Webhooks.StateMessage
+	}
+
+	// copied so the published state never shares maps with later merges
+	var custom MoonrakerObjects
+	for _, name := range pp.customObjects {
+		fields, exists := pp.objects[name]
+		if !exists {
+			continue
+		}
+		if custom == nil {
+			custom = make(MoonrakerObjects)
+		}
+		custom[name] = maps.Clone(fields)
+	}
+
+	pp.send(PrinterInfoStatsPair{
+		PrinterId: pp.printerId,
+		Stats:     status.Stats,
+		SDCard:    status.SDCard,
+		Extruder:  status.Extruder,
+		HeaterBed: status.HeaterBed,
+		Tools:     pp.tools(),
+		Objects:   custom,
+		Eta:       printEstimate(pp.config(), status.Stats, status.SDCard, pp.fileMetadata(status.Stats.Filename)),
+
+		KlippyState:  klippyState,
+		StateMessage: strings.TrimSpace(stateMessage),
+	})
+}
+
+// moonraker is up but klippy isn't. the poller has no klipper objects then, so
+// temperatures and progress read as zero and aren't real measurements.
+func klippyNotReady(p PrinterInfoStatsPair) bool {
+	return p.KlippyState != "" && p.KlippyState != "ready"
+}
+
+// metadata of the file being printed, nil until a fetch has succeeded
+func (pp *printerPoller) fileMetadata(filename string) *GcodeMetadata {
+	if filename == "" {
+		return nil
+	}
+
+	m := &pp.metadata
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if filename != m.filename {
+		m.filename, m.metadata, m.fetching, m.failures, m.retryAt = filename, nil, false, 0, time.Time{}
+	}
+	if m.metadata != nil || m.fetching || time.Now().Before(m.retryAt) {
+		return m.metadata
+	}
+
+	m.fetching = true
+	go pp.fetchFileMetadata(pp.config(), filename)
+	return nil
+}
+
+func (pp *printerPoller) fetchFileMetadata(p GTPrinterConfig, filename string) {
+	metadata, err := getGcodeMetadata(p, filename)
+
+	m := &pp.metadata
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if filename != m.filename {
+		// another file started printing meanwhile
+		return
+	}
+
+	m.fetching = false
+	if err != nil {
+		log.Println("Failed to get file metadata", moonrakerBaseUrl(p), err)
+		m.retryAt = time.Now().Add(min(metadataRetryInterval<<min(m.failures, 16), maxMetadataRetryInterval))
+		m.failures++
+		return
+	}
+	m.metadata = metadata
+}
+
+func (pp *printerPoller) tools() []ToolStats {
+	if len(pp.extruders) == 0 {
+		return nil
+	}
+
+	var toolhead struct {
+		Extruder string `json:"extruder"`
+	}
+	decodeObject(pp.objects["toolhead"], &toolhead)
+	active := toolhead.Extruder
+	if active == "" && len(pp.extruders) == 1 {
+		active = pp.extruders[0]
+	}
+
+	tools := make([]ToolStats, 0, len(pp.extruders))
+	for _, name := range pp.extruders {
+		var extruder ExtruderStats
+		if err := decodeObject(pp.objects[name], &extruder); err != nil {
+			continue
+		}
+		tools = append(tools, ToolStats{
+			Name:        name,
+			Temperature: extruder.Temperature,
+			Target:      extruder.Target,
+			Active:      name == active,
+		})
+	}
+	return tools
+}
+
+func (pp *printerPoller) send(ps PrinterInfoStatsPair) {
+	select {
+	case c <- Pair[PrinterInfoStatsPair, chan bool]{First: ps, Second: pp.quit}:
+	case <-pp.ctx.Done():
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	QueueJobQueued    = "queued"
+	QueueJobUploading = "uploading"
+	// uploaded and started, waiting for the printer to report it's printing
+	QueueJobStarting  = "starting"
+	QueueJobPrinting  = "printing"
+	QueueJobComplete  = "complete"
+	QueueJobFailed    = "failed"
+	QueueJobCancelled = "cancelled"
+
+	queueScheduleInterval = 5 * time.Second
+	queueStartTimeout     = 5 * time.Minute
+)
+
+type QueueJob struct {
+	Id       string `json:"id"`
+	Filename string `json:"filename"`
+	// constraints, a job without any runs on whichever printer frees up first
+	PrinterId string `json:"printer_id,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+	State     string `json:"state"`
+	// printer the job was handed to
+	AssignedTo string `json:"assigned_to,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Created    int64  `json:"created"`
+	Started    int64  `json:"started,omitempty"`
+	Finished   int64  `json:"finished,omitempty"`
+}
+
+type PrintQueue struct {
+	Jobs []QueueJob `json:"jobs"`
+	// printers whose bed was cleared since their last job, only these get new work
+	Cleared []string `json:"cleared"`
+}
+
+var (
+	Queue     = PrintQueue{Jobs: make([]QueueJob, 0), Cleared: make([]string, 0)}
+	QueueLock sync.Mutex
+
+	queueKick = make(chan bool, 1)
+)
+
+func queueFile() string {
+	return filepath.Join(filepath.Dir(configPath), "print_queue.json")
+}
+
+func loadQueue() {
+	content, err := os.ReadFile(queueFile())
+	if err != nil {
+		return
+	}
+
+	var q PrintQueue
+	if err := json.Unmarshal(content, &q); err != nil {
+		log.Println("Failed to load print queue", err)
+		return
+	}
+
+	QueueLock.Lock()
+	defer QueueLock.Unlock()
+	for i := range q.Jobs {
+		// the upload died with the previous process
+		if q.Jobs[i].State == QueueJobUploading {
+			q.Jobs[i].State = QueueJobFailed
+			q.Jobs[i].Error = "interrupted by a restart"
+			q.Jobs[i].Finished = time.Now().Unix()
+		}
+	}
+	if q.Jobs != nil {
+		Queue.Jobs = q.Jobs
+	}
+	if q.Cleared != nil {
+		Queue.Cleared = q.Cleared
+	}
+}
+
+// callers must hold QueueLock
+func saveQueue() {
+	content, err := json.Marshal(&Queue)
+	if err != nil {
+		log.Println("Failed to encode print queue", err)
+		return
+	}
+
+	tmpFile := queueFile() + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		log.Println("Failed to save print queue", err)
+		return
+	}
+	if err := os.Rename(tmpFile, queueFile()); err != nil {
+		log.Println("Failed to save print queue", err)
+	}
+}
+
+// callers must hold QueueLock
+func findQueueJob(jobId string) int {
+	return slices.IndexFunc(Queue.Jobs, func(j QueueJob) bool {
+		return j.Id == jobId
+	})
+}
+
+func isQueueJobActive(state string) bool {
+	return state == QueueJobUploading || state == QueueJobStarting || state == QueueJobPrinting
+}
+
+func isPrinterCleared(printerId string) bool {
+	QueueLock.Lock()
+	defer QueueLock.Unlock()
+	return slices.Contains(Queue.Cleared, printerId)
+}
+
+// callers must hold QueueLock
+func setQueueCleared(printerId string, cleared bool) {
+	Queue.Cleared = slices.DeleteFunc(Queue.Cleared, func(id string) bool {
+		return id == printerId
+	})
+	if cleared {
+		Queue.Cleared = append(Queue.Cleared, printerId)
+	}
+}
+
+// must be called without QueueLock, the consumer takes the locks the other way around
+func publishCleared(printerId string, cleared bool) {
+	PrintersMapLock.Lock()
+	defer PrintersMapLock.Unlock()
+	if p, exists := Printers[printerId]; exists {
+		p.Cleared = cleared
+		Printers[printerId] = p
+		PrinterStream.publishPrinter(p)
+	}
+}
+
+// fails jobs pinned or handed to a removed printer, pinned jobs could never run otherwise
+func deletePrinterQueue(printerId string) {
+	QueueLock.Lock()
+	defer QueueLock.Unlock()
+	for i := range Queue.Jobs {
+		j := &Queue.Jobs[i]
+		pinned := j.State == QueueJobQueued && j.PrinterId == printerId
+		assigned := isQueueJobActive(j.State) && j.AssignedTo == printerId
+		if pinned || assigned {
+			j.finish(QueueJobFailed, "printer was removed")
+		}
+	}
+	setQueueCleared(printerId, false)
+	saveQueue()
+}
+
+func kickQueue() {
+	select {
+	case queueKick <- true:
+	default:
+	}
+}
+
+func isPrinterIdle(p PrinterInfoStatsPair) bool {
+	if p.KlippyState != "ready" {
+		return false
+	}
+	switch p.Stats.State {
+	case "standby", "complete", "cancelled":
+		return true
+	}
+	return false
+}
+
+// callers must hold QueueLock
+func (j *QueueJob) finish(state string, message string) {
+	j.State = state
+	j.Error = message
+	j.Finished = time.Now().Unix()
+}
+
+// follows assigned jobs through the printer's state
+// callers must hold QueueLock
+func trackQueueJob(j *QueueJob, p PrinterInfoStatsPair, exists bool, now time.Time) {
+	if !exists {
+		j.finish(QueueJobFailed, "printer was removed")
+		return
+	}
+
+	state := p.Stats.State
+	if state == "offline" {
+		return
+	}
+
+	switch j.State {
+	case QueueJobStarting:
+		if (state == "printing" || state == "paused") && p.Stats.Filename == j.Filename {
+			j.State = QueueJobPrinting
+		} else if now.Sub(time.Unix(j.Started, 0)) > queueStartTimeout {
+			j.finish(QueueJobFailed, "printer didn't start printing "+j.Filename)
+		}
+	case QueueJobPrinting:
+		switch state {
+		case "printing", "paused":
+		case "complete":
+			j.finish(QueueJobComplete, "")
+		case "cancelled":
+			j.finish(QueueJobCancelled, p.Stats.Message)
+		default:
+			message := p.Stats.Message
+			if message == "" {
+				message = "print stopped, printer is " + state
+			}
+			j.finish(QueueJobFailed, message)
+		}
+	}
+}
+
+// updates assigned jobs and hands queued jobs to idle, cleared printers
+func scheduleQueue() {
+	PrintersMapLock.RLock()
+	printers := getSortedPrinters()
+	PrintersMapLock.RUnlock()
+
+	assigned := make([]QueueJob, 0)
+
+	QueueLock.Lock()
+	now := time.Now()
+	changed := false
+	busy := make(map[string]bool)
+	for i := range Queue.Jobs {
+		j := &Queue.Jobs[i]
+		if !isQueueJobActive(j.State) {
+			continue
+		}
+		if state := j.State; state != QueueJobUploading {
+			idx := slices.IndexFunc(printers, func(p PrinterInfoStatsPair) bool {
+				return p.PrinterId == j.AssignedTo
+			})
+			var p PrinterInfoStatsPair
+			if idx >= 0 {
+				p = printers[idx]
+			}
+			trackQueueJob(j, p, idx >= 0, now)
+			changed = changed || j.State != state
+		}
+		if isQueueJobActive(j.State) {
+			busy[j.AssignedTo] = true
+		}
+	}
+
+	for i := range Queue.Jobs {
+		j := &Queue.Jobs[i]
+		if j.State != QueueJobQueued {
+			continue
+		}
+		for _, p := range printers {
+			if busy[p.PrinterId] || !slices.Contains(Queue.Cleared, p.PrinterId) || !isPrinterIdle(p) {
+				continue
+			}
+			if (j.PrinterId != "" && j.PrinterId != p.PrinterId) || (j.Tag != "" && !slices.Contains(p.PrinterInfo.Tags, j.Tag)) {
+				continue
+			}
+
+			j.State = QueueJobUploading
+			j.AssignedTo = p.PrinterId
+			j.Started = now.Unix()
+			j.Error = ""
+			busy[p.PrinterId] = true
+			// the next job needs someone to clear the bed first
+			setQueueCleared(p.PrinterId, false)
+			assigned = append(assigned, *j)
+			break
+		}
+	}
+	if changed || len(assigned) > 0 {
+		saveQueue()
+	}
+	QueueLock.Unlock()
+
+	for _, j := range assigned {
+		log.Println("Queue assigned", j.Filename, "to printer", j.AssignedTo)
+		publishCleared(j.AssignedTo, false)
+		go startQueueJob(j)
+	}
+}
+
+func startQueueJob(j QueueJob) {
+	err := uploadQueueJob(j)
+
+	QueueLock.Lock()
+	defer QueueLock.Unlock()
+	idx := findQueueJob(j.Id)
+	if idx < 0 || Queue.Jobs[idx].State != QueueJobUploading {
+		// cancelled or removed while uploading, the print started anyway
+		if err == nil {
+			go runPrinterAction(j.AssignedTo, ActionCancel)
+		}
+		return
+	}
+	if err != nil {
+		log.Println("Queue job", j.Filename, "failed on printer", j.AssignedTo, err)
+		Queue.Jobs[idx].finish(QueueJobFailed, err.Error())
+	} else {
+		Queue.Jobs[idx].State = QueueJobStarting
+	}
+	saveQueue()
+}
+
+func uploadQueueJob(j QueueJob) error {
+	PrintersMapLock.RLock()
+	printer, exists := Printers[j.AssignedTo]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		return errors.New("printer not found")
+	}
+
+	f, err := os.Open(filepath.Join(uploadsDir(), j.Filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	result, err := moonrakerUploadFile(ctx, printer.PrinterInfo, "gcodes", j.Filename, f, info.Size(), true)
+	if err != nil {
+		return err
+	}
+	if !result.PrintStarted {
+		return errors.New("uploaded, but moonraker didn't start the print")
+	}
+
+	PrintersMapLock.RLock()
+	wakePrinterPoller(j.AssignedTo)
+	PrintersMapLock.RUnlock()
+	return nil
+}
+
+func startQueueScheduler() {
+	loadQueue()
+	go func() {
+		ticker := time.NewTicker(queueScheduleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-queueKick:
+			}
+			scheduleQueue()
+		}
+	}()
+}
+
+func writeQueue(w http.ResponseWriter) {
+	QueueLock.Lock()
+	content, err := json.Marshal(&Queue)
+	QueueLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeQueue(w)
+	case "POST":
+		var req struct {
+			Filename  string `json:"filename"`
+			PrinterId string `json:"printer_id"`
+			Tag       string `json:"tag"`
+			Copies    int    `json:"copies"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to decode queue job json", http.StatusBadRequest)
+			return
+		}
+
+		filename := uploadFilename(req.Filename)
+		if filename == "" || filename != req.Filename {
+			http.Error(w, "Invalid filename", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(uploadsDir(), filename)); err != nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		if req.PrinterId != "" {
+			PrintersMapLock.RLock()
+			_, exists := Printers[req.PrinterId]
+			PrintersMapLock.RUnlock()
+			if !exists {
+				http.Error(w, "printer not found", http.StatusNotFound)
+				return
+			}
+		}
+		// 0 or left out queues a single job
+		if req.Copies < 0 || req.Copies > 100 {
+			http.Error(w, "copies must be between 0 and 100, 0 queues one job", http.StatusBadRequest)
+			return
+		}
+
+		jobs := make([]QueueJob, max(req.Copies, 1))
+		for i := range jobs {
+			jobs[i] = QueueJob{
+				Id:        newEventId(),
+				Filename:  filename,
+				PrinterId: req.PrinterId,
+				Tag:       req.Tag,
+				State:     QueueJobQueued,
+				Created:   time.Now().Unix(),
+			}
+		}
+
+		QueueLock.Lock()
+		Queue.Jobs = append(Queue.Jobs, jobs...)
+		saveQueue()
+		QueueLock.Unlock()
+		kickQueue()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&jobs)
+	case "PUT":
+		// queued jobs in the given order first, everything else keeps its place after them
+		var req struct {
+			Order []string `json:"order"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to decode queue order json", http.StatusBadRequest)
+			return
+		}
+
+		QueueLock.Lock()
+		reordered := make([]QueueJob, 0, len(Queue.Jobs))
+		for _, id := range req.Order {
+			if idx := findQueueJob(id); idx >= 0 && Queue.Jobs[idx].State == QueueJobQueued &&
+				!slices.ContainsFunc(reordered, func(j QueueJob) bool { return j.Id == id }) {
+				reordered = append(reordered, Queue.Jobs[idx])
+			}
+		}
+		for _, j := range Queue.Jobs {
+			if !slices.ContainsFunc(reordered, func(o QueueJob) bool { return o.Id == j.Id }) {
+				reordered = append(reordered, j)
+			}
+		}
+		Queue.Jobs = reordered
+		saveQueue()
+		QueueLock.Unlock()
+
+		writeQueue(w)
+	default:
+		http.Error(w, "405 unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func cancelQueueJobHandler(w http.ResponseWriter, r *http.Request) {
+	QueueLock.Lock()
+	idx := findQueueJob(r.PathValue("jobId"))
+	if idx < 0 {
+		QueueLock.Unlock()
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	j := Queue.Jobs[idx]
+	if j.State != QueueJobQueued && !isQueueJobActive(j.State) {
+		QueueLock.Unlock()
+		http.Error(w, "job already finished", http.StatusConflict)
+		return
+	}
+	Queue.Jobs[idx].finish(QueueJobCancelled, "")
+	saveQueue()
+	QueueLock.Unlock()
+
+	if j.State == QueueJobStarting || j.State == QueueJobPrinting {
+		result := runPrinterAction(j.AssignedTo, ActionCancel)
+		if !result.Ok {
+			http.Error(w, "job cancelled, but the printer didn't cancel: "+result.Error, http.StatusBadGateway)
+			return
+		}
+	}
+	writeQueue(w)
+}
+
+func retryQueueJobHandler(w http.ResponseWriter, r *http.Request) {
+	QueueLock.Lock()
+	idx := findQueueJob(r.PathValue("jobId"))
+	if idx < 0 {
+		QueueLock.Unlock()
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	j := &Queue.Jobs[idx]
+	if j.State != QueueJobFailed && j.State != QueueJobCancelled {
+		QueueLock.Unlock()
+		http.Error(w, "only failed or cancelled jobs can be retried", http.StatusConflict)
+		return
+	}
+	j.State = QueueJobQueued
+	j.AssignedTo = ""
+	j.Error = ""
+	j.Started = 0
+	j.Finished = 0
+	saveQueue()
+	QueueLock.Unlock()
+	kickQueue()
+
+	writeQueue(w)
+}
+
+func deleteQueueJobHandler(w http.ResponseWriter, r *http.Request) {
+	QueueLock.Lock()
+	defer QueueLock.Unlock()
+	idx := findQueueJob(r.PathValue("jobId"))
+	if idx < 0 {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if isQueueJobActive(Queue.Jobs[idx].State) {
+		http.Error(w, "cancel the job before removing it", http.StatusConflict)
+		return
+	}
+
+	Queue.Jobs = slices.Delete(Queue.Jobs, idx, idx+1)
+	saveQueue()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST marks the printer's bed as cleared and ready for the next job, DELETE takes it back
+func printerClearedHandler(w http.ResponseWriter, r *http.Request) {
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	_, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+
+	cleared := r.Method == http.MethodPost
+	QueueLock.Lock()
+	setQueueCleared(printerId, cleared)
+	saveQueue()
+	QueueLock.Unlock()
+
+	publishCleared(printerId, cleared)
+	if cleared {
+		kickQueue()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
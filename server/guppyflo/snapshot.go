@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxSnapshotSize = 8 * 1024 * 1024
+
+// collects a proxied response in memory
+type snapshotRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *snapshotRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *snapshotRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *snapshotRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.body.Len()+len(b) > maxSnapshotSize {
+		return 0, errors.New("snapshot too large")
+	}
+	return r.body.Write(b)
+}
+
+// still image endpoint next to the camera's stream
+func cameraSnapshotPath(cam GTPrinterCamerasConfig) (string, error) {
+	switch cam.Type {
+	case "go2rtc":
+		// /stream.html?src=cam1 -> /api/frame.jpeg?src=cam1
+		_, query, _ := strings.Cut(cam.Path, "?")
+		return "/api/frame.jpeg?" + query, nil
+	case "mjpeg-stream":
+		// ?action=stream(_N) -> ?action=snapshot(_N)
+		if strings.Contains(cam.Path, "action=stream") {
+			return strings.Replace(cam.Path, "action=stream", "action=snapshot", 1), nil
+		}
+		return "", fmt.Errorf("camera path %s has no stream action", cam.Path)
+	}
+	return "", fmt.Errorf("unknown camera type %s", cam.Type)
+}
+
+// grabs a JPEG from the printer's first camera through its camera proxy
+func printerSnapshot(printerId string) ([]byte, error) {
+	PrintersMapLock.RLock()
+	printer, exists := Printers[printerId]
+	mux, muxExists := CameraMuxes[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists || !muxExists || len(printer.PrinterInfo.Cameras) == 0 {
+		return nil, errors.New("printer has no camera")
+	}
+
+	cam := printer.PrinterInfo.Cameras[0]
+	snapshotPath, err := cameraSnapshotPath(cam)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	target := fmt.Sprintf("/printers/%s/cameras/%s%s", printerId, getCameraId(cam), snapshotPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &snapshotRecorder{header: make(http.Header)}
+	mux.ServeHTTP(rec, req)
+	if rec.status != http.StatusOK {
+		return nil, fmt.Errorf("camera snapshot failed with status %d", rec.status)
+	}
+	if contentType := rec.header.Get("Content-Type"); !strings.HasPrefix(contentType, "image/jpeg") {
+		return nil, fmt.Errorf("camera snapshot is %s, not a jpeg", contentType)
+	}
+	return rec.body.Bytes(), nil
+}
+
+func printerSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	_, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+
+	snapshot, err := printerSnapshot(printerId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(snapshot)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type PrinterStreamEvent struct {
+	Type string
+	Data any
+}
+
+// fans out printer updates to streaming clients. only the top level fields of a
+// printer that changed since the last update are sent.
+type PrinterStreamHub struct {
+	lock        sync.Mutex
+	subscribers map[chan PrinterStreamEvent]bool
+	last        map[string]map[string]json.RawMessage
+}
+
+var PrinterStream = &PrinterStreamHub{
+	subscribers: make(map[chan PrinterStreamEvent]bool),
+	last:        make(map[string]map[string]json.RawMessage),
+}
+
+func (h *PrinterStreamHub) subscribe() chan PrinterStreamEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	events := make(chan PrinterStreamEvent, 64)
+	h.subscribers[events] = true
+	return events
+}
+
+func (h *PrinterStreamHub) unsubscribe(events chan PrinterStreamEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, exists := h.subscribers[events]; exists {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+// callers must hold the lock
+func (h *PrinterStreamHub) broadcast(e PrinterStreamEvent) {
+	for events := range h.subscribers {
+		select {
+		case events <- e:
+		default:
+			// client can't keep up, drop it and let it reconnect for a fresh snapshot
+			delete(h.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// publishPrinter must be called while holding PrintersMapLock so the diff
+// baseline stays in sync with the snapshot handed to new subscribers.
+func (h *PrinterStreamHub) publishPrinter(p PrinterInfoStatsPair) {
+	p.Diagnostics = getPrinterDiagnostics(p.PrinterId)
+	content, err := json.Marshal(&p)
+	if err != nil {
+		log.Println("error encoding printer for stream", err)
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		log.Println("error encoding printer for stream", err)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	prev := h.last[p.PrinterId]
+	h.last[p.PrinterId] = fields
+
+	diff := make(map[string]json.RawMessage)
+	for k, v := range fields {
+		if pv, exists := prev[k]; !exists || string(pv) != string(v) {
+			diff[k] = v
+		}
+	}
+	// omitempty fields that went away, e.g. cleared alerts
+	for k := range prev {
+		if _, exists := fields[k]; !exists {
+			diff[k] = json.RawMessage("null")
+		}
+	}
+
+	if len(diff) == 0 {
+		return
+	}
+
+	diff["id"] = fields["id"]
+	h.broadcast(PrinterStreamEvent{Type: "printer", Data: diff})
+}
+
+func (h *PrinterStreamHub) publishDelete(printerId string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.last, printerId)
+	h.broadcast(PrinterStreamEvent{
+		Type: "delete",
+		Data: map[string]string{"id": printerId},
+	})
+}
+
+func writeStreamEvent(w http.ResponseWriter, e PrinterStreamEvent) error {
+	content, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, content)
+	return err
+}
+
+func printerStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	PrintersMapLock.RLock()
+	snapshot := getSortedPrinters()
+	addPrinterDiagnostics(snapshot)
+	events := PrinterStream.subscribe()
+	PrintersMapLock.RUnlock()
+	defer PrinterStream.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	if err := writeStreamEvent(w, PrinterStreamEvent{Type: "snapshot", Data: snapshot}); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := writeStreamEvent(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readStreamEvent(t *testing.T, r *bufio.Reader) (string, json.RawMessage) {
+	t.Helper()
+	var eventType string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			eventType = v
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			return eventType, json.RawMessage(v)
+		}
+	}
+}
+
+func TestPrinterStreamIncludesDiagnostics(t *testing.T) {
+	prevPrinters, prevDiagnostics, prevStream := Printers, Diagnostics, PrinterStream
+	t.Cleanup(func() { Printers, Diagnostics, PrinterStream = prevPrinters, prevDiagnostics, prevStream })
+	Printers = map[string]PrinterInfoStatsPair{
+		"p1": {PrinterId: "p1", Stats: PrinterStats{State: "offline"}},
+	}
+	Diagnostics = make(map[string]*diagnosticsRecorder)
+	PrinterStream = &PrinterStreamHub{
+		subscribers: make(map[chan PrinterStreamEvent]bool),
+		last:        make(map[string]map[string]json.RawMessage),
+	}
+	recordPollFailure("p1", "http", errors.New("connection refused"))
+
+	srv := httptest.NewServer(http.HandlerFunc(printerStreamHandler))
+	t.Cleanup(srv.Close)
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+
+	eventType, data := readStreamEvent(t, r)
+	var snapshot []PrinterInfoStatsPair
+	if err := json.Unmarshal(data, &snapshot); err != nil || eventType != "snapshot" || len(snapshot) != 1 {
+		t.Fatalf("first event = %s %s", eventType, data)
+	}
+	if d := snapshot[0].Diagnostics; d == nil || d.ConsecutiveFailures != 1 || d.LastError != "connection refused" {
+		t.Errorf("snapshot diagnostics = %+v", d)
+	}
+
+	// the handler subscribes before writing the snapshot, so this reaches it
+	recordPollSuccess("p1", "websocket", time.Millisecond)
+	PrintersMapLock.Lock()
+	PrinterStream.publishPrinter(PrinterInfoStatsPair{PrinterId: "p1", Stats: PrinterStats{State: "standby"}})
+	PrintersMapLock.Unlock()
+
+	eventType, data = readStreamEvent(t, r)
+	var diff struct {
+		Diagnostics *PrinterDiagnostics `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(data, &diff); err != nil || eventType != "printer" {
+		t.Fatalf("second event = %s %s", eventType, data)
+	}
+	if d := diff.Diagnostics; d == nil || d.Transport != "websocket" || d.ConsecutiveFailures != 0 {
+		t.Errorf("diff diagnostics = %+v", d)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxCachedThumbnails = 200
+
+type GcodeThumbnail struct {
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Size         int    `json:"size"`
+	RelativePath string `json:"relative_path"`
+}
+
+func thumbnailDir() string {
+	return filepath.Join(filepath.Dir(configPath), "thumbnails")
+}
+
+// prefers the smallest thumbnail at least as wide as requested, otherwise the largest
+func pickThumbnail(thumbnails []GcodeThumbnail, width int) *GcodeThumbnail {
+	var picked *GcodeThumbnail
+	for i := range thumbnails {
+		t := &thumbnails[i]
+		switch {
+		case picked == nil:
+			picked = t
+		case width > 0 && t.Width >= width && (picked.Width < width || t.Width < picked.Width):
+			picked = t
+		case (width <= 0 || picked.Width < width) && t.Width > picked.Width:
+			picked = t
+		}
+	}
+	return picked
+}
+
+func escapeFilePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+func fetchThumbnail(p GTPrinterConfig, thumbnailPath string, dest string) error {
+	resp, err := moonrakerRequest(p, http.MethodGet, "/server/files/gcodes/"+escapeFilePath(thumbnailPath), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("thumbnail request for %s failed: %s", thumbnailPath, resp.Status)
+	}
+
+	if err := os.MkdirAll(thumbnailDir(), 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(thumbnailDir(), "thumbnail-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = io.Copy(tmpFile, resp.Body)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), dest); err != nil {
+		return err
+	}
+	pruneThumbnails()
+	return nil
+}
+
+// cached thumbnail for the key and whether there is one. a hit counts as a use, so
+// pruning drops the least recently served thumbnails.
+func findCachedThumbnail(cacheKey string) (string, bool) {
+	matches, _ := filepath.Glob(filepath.Join(thumbnailDir(), cacheKey+".*"))
+	if len(matches) == 0 {
+		return "", false
+	}
+	now := time.Now()
+	os.Chtimes(matches[0], now, now)
+	return matches[0], true
+}
+
+// keeps the cache from growing forever on small flash storage
+func pruneThumbnails() {
+	entries, err := os.ReadDir(thumbnailDir())
+	if err != nil || len(entries) <= maxCachedThumbnails {
+		return
+	}
+
+	files := make([]Pair[string, time.Time], 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, Pair[string, time.Time]{First: e.Name(), Second: info.ModTime()})
+	}
+
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].Second.Before(files[b].Second)
+	})
+
+	for _, f := range files[:max(len(files)-maxCachedThumbnails, 0)] {
+		os.Remove(filepath.Join(thumbnailDir(), f.First))
+	}
+}
+
+// serves the thumbnail of the active print. the optional file query parameter is
+// only there so browsers cache per job, the active file always wins.
+func printerThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	printer, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+
+	filename := printer.Stats.Filename
+	if filename == "" {
+		http.Error(w, "printer has no active file", http.StatusNotFound)
+		return
+	}
+
+	width, _ := strconv.Atoi(r.URL.Query().Get("width"))
+
+	// keyed on what the printer already reports so a hit needs no moonraker request.
+	// a re-uploaded file almost always changes size and with it the cache entry.
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d", printerId, filename, printer.SDCard.FileSize, width)))
+	cacheKey := hex.EncodeToString(sum[:])
+	cacheFile, hit := findCachedThumbnail(cacheKey)
+
+	if !hit {
+		metadata, err := getGcodeMetadata(printer.PrinterInfo, filename)
+		if err != nil {
+			http.Error(w, "failed to get file metadata", http.StatusBadGateway)
+			return
+		}
+
+		thumbnail := pickThumbnail(metadata.Thumbnails, width)
+		if thumbnail == nil {
+			http.Error(w, "file has no thumbnails", http.StatusNotFound)
+			return
+		}
+
+		thumbnailPath := path.Join(path.Dir(filename), thumbnail.RelativePath)
+		cacheFile = filepath.Join(thumbnailDir(), cacheKey+path.Ext(thumbnailPath))
+		if err := fetchThumbnail(printer.PrinterInfo, thumbnailPath, cacheFile); err != nil {
+			log.Println("Failed to fetch thumbnail", printerId, err)
+			http.Error(w, "failed to fetch thumbnail", http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", `"`+cacheKey+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeFile(w, r, cacheFile)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrinterThumbnailHandlerCache(t *testing.T) {
+	var requests atomic.Int32
+	moonraker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/server/files/metadata":
+			w.Write([]byte(`{"result":{"filename":"parts/a.gcode","modified":1,"thumbnails":[{"width":32,"height":32,"relative_path":".thumbs/a-32x32.png"},{"width":300,"height":300,"relative_path":".thumbs/a-300x300.png"}]}}`))
+		case "/server/files/gcodes/parts/.thumbs/a-300x300.png":
+			w.Write([]byte("png 300"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(moonraker.Close)
+
+	prevConfigPath, prevPrinters := configPath, Printers
+	t.Cleanup(func() { configPath, Printers = prevConfigPath, prevPrinters })
+	configPath = filepath.Join(t.TempDir(), "guppytunnel.json")
+	Printers = map[string]PrinterInfoStatsPair{
+		"p1": {
+			PrinterId:   "p1",
+			PrinterInfo: GTPrinterConfig{MoonrakerUrl: moonraker.URL},
+			Stats:       PrinterStats{State: "printing", Filename: "parts/a.gcode"},
+			SDCard:      VirtualSDCard{FileSize: 1234},
+		},
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/api/printers/p1/thumbnail?width=200", nil)
+		req.SetPathValue("printerId", "p1")
+		rec := httptest.NewRecorder()
+		printerThumbnailHandler(rec, req)
+		return rec
+	}
+
+	rec := get()
+	if rec.Code != http.StatusOK || rec.Body.String() != "png 300" {
+		t.Fatalf("first request = %d %q", rec.Code, rec.Body.String())
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("first request made %d moonraker requests, want metadata and thumbnail", n)
+	}
+
+	cached, err := filepath.Glob(filepath.Join(thumbnailDir(), "*.png"))
+	if err != nil || len(cached) != 1 {
+		t.Fatalf("cached thumbnails = %v %v", cached, err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(cached[0], old, old)
+
+	requests.Store(0)
+	rec = get()
+	if rec.Code != http.StatusOK || rec.Body.String() != "png 300" {
+		t.Fatalf("cached request = %d %q", rec.Code, rec.Body.String())
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("cached request made %d moonraker requests", n)
+	}
+	if info, err := os.Stat(cached[0]); err != nil || !info.ModTime().After(old) {
+		t.Errorf("cache hit didn't refresh the entry for pruning")
+	}
+}
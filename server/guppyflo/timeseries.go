@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PrinterSample struct {
+	Time           int64   `json:"time"`
+	ExtruderTemp   float64 `json:"extruder_temperature"`
+	ExtruderTarget float64 `json:"extruder_target"`
+	BedTemp        float64 `json:"heater_bed_temperature"`
+	BedTarget      float64 `json:"heater_bed_target"`
+	Progress       float64 `json:"progress"`
+}
+
+// fixed size ring of samples where each slot averages everything recorded
+// within its resolution window
+type SampleRing struct {
+	Resolution int64           `json:"resolution"`
+	Samples    []PrinterSample `json:"samples"`
+	Start      int             `json:"start"`
+	Count      int             `json:"count"`
+	// samples averaged into the newest slot, kept so a restart keeps averaging
+	Merged int `json:"merged"`
+}
+
+type PrinterHistory struct {
+	Tiers []*SampleRing `json:"tiers"`
+	dirty bool
+}
+
+const historySaveInterval = 5 * time.Minute
+
+var (
+	// finest to coarsest, ~2800 samples per printer for a week of history
+	historyTiers = []struct {
+		Resolution int64
+		Retention  time.Duration
+	}{
+		{10, time.Hour},
+		{60, 24 * time.Hour},
+		{600, 7 * 24 * time.Hour},
+	}
+
+	PrinterHistories = make(map[string]*PrinterHistory)
+	HistoryLock      sync.Mutex
+)
+
+func newPrinterHistory() *PrinterHistory {
+	h := &PrinterHistory{}
+	for _, t := range historyTiers {
+		h.Tiers = append(h.Tiers, &SampleRing{
+			Resolution: t.Resolution,
+			Samples:    make([]PrinterSample, int64(t.Retention.Seconds())/t.Resolution),
+		})
+	}
+	return h
+}
+
+func (r *SampleRing) newest() *PrinterSample {
+	if r.Count == 0 {
+		return nil
+	}
+	return &r.Samples[(r.Start+r.Count-1)%len(r.Samples)]
+}
+
+func (r *SampleRing) add(s PrinterSample) {
+	s.Time = s.Time - s.Time%r.Resolution
+	last := r.newest()
+	if last != nil && last.Time == s.Time {
+		// running average within the same window
+		n := float64(r.Merged)
+		last.ExtruderTemp = (last.ExtruderTemp*n + s.ExtruderTemp) / (n + 1)
+		last.ExtruderTarget = s.ExtruderTarget
+		last.BedTemp = (last.BedTemp*n + s.BedTemp) / (n + 1)
+		last.BedTarget = s.BedTarget
+		last.Progress = s.Progress
+		r.Merged++
+		return
+	}
+
+	if last != nil && s.Time < last.Time {
+		return
+	}
+
+	r.Merged = 1
+	if r.Count < len(r.Samples) {
+		r.Samples[(r.Start+r.Count)%len(r.Samples)] = s
+		r.Count++
+		return
+	}
+	r.Samples[r.Start] = s
+	r.Start = (r.Start + 1) % len(r.Samples)
+}
+
+func (r *SampleRing) oldest() int64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Samples[r.Start].Time
+}
+
+func (r *SampleRing) between(from int64, to int64) []PrinterSample {
+	samples := make([]PrinterSample, 0)
+	for i := 0; i < r.Count; i++ {
+		s := r.Samples[(r.Start+i)%len(r.Samples)]
+		if s.Time >= from && s.Time <= to {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+func (h *PrinterHistory) record(s PrinterSample) {
+	for _, t := range h.Tiers {
+		t.add(s)
+	}
+	h.dirty = true
+}
+
+// query picks the finest tier still covering from, then averages down to the
+// requested resolution
+func (h *PrinterHistory) query(from int64, to int64, resolution int64) (int64, []PrinterSample) {
+	tier := h.Tiers[len(h.Tiers)-1]
+	for _, t := range h.Tiers {
+		// a ring that hasn't wrapped yet holds everything recorded so far
+		if t.Count < len(t.Samples) || t.oldest() <= from {
+			tier = t
+			break
+		}
+	}
+
+	samples := tier.between(from, to)
+	if resolution <= tier.Resolution {
+		return tier.Resolution, samples
+	}
+
+	downsampled := &SampleRing{
+		Resolution: resolution,
+		Samples:    make([]PrinterSample, len(samples)),
+	}
+	for _, s := range samples {
+		downsampled.add(s)
+	}
+	return resolution, downsampled.between(from, to)
+}
+
+func historyDir() string {
+	return filepath.Join(filepath.Dir(configPath), "history")
+}
+
+func historyFile(printerId string) string {
+	return filepath.Join(historyDir(), printerId+".json")
+}
+
+// callers must hold HistoryLock
+func getPrinterHistory(printerId string) *PrinterHistory {
+	h, exists := PrinterHistories[printerId]
+	if exists {
+		return h
+	}
+
+	h = newPrinterHistory()
+	content, err := os.ReadFile(historyFile(printerId))
+	if err == nil {
+		var saved PrinterHistory
+		err = json.Unmarshal(content, &saved)
+		if err == nil && len(saved.Tiers) == len(h.Tiers) {
+			for i, t := range saved.Tiers {
+				if t.Resolution == h.Tiers[i].Resolution && len(t.Samples) == len(h.Tiers[i].Samples) {
+					h.Tiers[i] = t
+				}
+			}
+		} else if err != nil {
+			log.Println("Failed to load printer history", printerId, err)
+		}
+	}
+
+	PrinterHistories[printerId] = h
+	return h
+}
+
+func recordPrinterHistory(p PrinterInfoStatsPair) {
+	if p.Stats.State == "offline" || klippyNotReady(p) {
+		return
+	}
+
+	HistoryLock.Lock()
+	defer HistoryLock.Unlock()
+	getPrinterHistory(p.PrinterId).record(PrinterSample{
+		Time:           time.Now().Unix(),
+		ExtruderTemp:   p.Extruder.Temperature,
+		ExtruderTarget: p.Extruder.Target,
+		BedTemp:        p.HeaterBed.Temperature,
+		BedTarget:      p.HeaterBed.Target,
+		Progress:       p.SDCard.Progress,
+	})
+}
+
+func deletePrinterHistory(printerId string) {
+	HistoryLock.Lock()
+	defer HistoryLock.Unlock()
+	delete(PrinterHistories, printerId)
+	err := os.Remove(historyFile(printerId))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to delete printer history", printerId, err)
+	}
+}
+
+func savePrinterHistories() {
+	HistoryLock.Lock()
+	defer HistoryLock.Unlock()
+
+	if err := os.MkdirAll(historyDir(), 0755); err != nil {
+		log.Println("Failed to create history directory", err)
+		return
+	}
+
+	for printerId, h := range PrinterHistories {
+		if !h.dirty {
+			continue
+		}
+
+		content, err := json.Marshal(h)
+		if err != nil {
+			log.Println("Failed to encode printer history", printerId, err)
+			continue
+		}
+
+		tmpFile := historyFile(printerId) + ".tmp"
+		if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+			log.Println("Failed to save printer history", printerId, err)
+			continue
+		}
+		if err := os.Rename(tmpFile, historyFile(printerId)); err != nil {
+			log.Println("Failed to save printer history", printerId, err)
+			continue
+		}
+		h.dirty = false
+	}
+}
+
+func startHistoryPersister() {
+	go func() {
+		for range time.Tick(historySaveInterval) {
+			savePrinterHistories()
+		}
+	}()
+}
+
+func parseUnixParam(r *http.Request, name string, fallback int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// values of a query parameter that may be repeated or comma separated,
+// ?printer=a&printer=b and ?printer=a,b are the same
+func parseListParam(r *http.Request, name string) []string {
+	values := make([]string, 0)
+	for _, v := range r.URL.Query()[name] {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+func printerHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	printerId := r.PathValue("printerId")
+	PrintersMapLock.RLock()
+	_, exists := Printers[printerId]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		http.Error(w, "printer not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().Unix()
+	to, err := parseUnixParam(r, "to", now)
+	if err != nil {
+		http.Error(w, "bad to timestamp", http.StatusBadRequest)
+		return
+	}
+	from, err := parseUnixParam(r, "from", to-3600)
+	if err != nil {
+		http.Error(w, "bad from timestamp", http.StatusBadRequest)
+		return
+	}
+	resolution, err := parseUnixParam(r, "resolution", 0)
+	if err != nil || resolution < 0 {
+		http.Error(w, "bad resolution", http.StatusBadRequest)
+		return
+	}
+
+	HistoryLock.Lock()
+	resolution, samples := getPrinterHistory(printerId).query(from, to, resolution)
+	HistoryLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]any{
+		"id":         printerId,
+		"from":       from,
+		"to":         to,
+		"resolution": resolution,
+		"samples":    samples,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSampleRingAdd(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		resolution int64
+		add        []PrinterSample
+		want       []PrinterSample
+		wantMerged int
+	}{
+		{
+			name:       "aligned to the window",
+			size:       4,
+			resolution: 10,
+			add:        []PrinterSample{{Time: 1003, ExtruderTemp: 200}},
+			want:       []PrinterSample{{Time: 1000, ExtruderTemp: 200}},
+			wantMerged: 1,
+		},
+		{
+			name:       "averaged within a window",
+			size:       4,
+			resolution: 10,
+			add: []PrinterSample{
+				{Time: 1000, ExtruderTemp: 200, ExtruderTarget: 210, BedTemp: 60, Progress: 0.1},
+				{Time: 1004, ExtruderTemp: 205, ExtruderTarget: 210, BedTemp: 62, Progress: 0.2},
+				{Time: 1009, ExtruderTemp: 210, ExtruderTarget: 215, BedTemp: 64, Progress: 0.3},
+			},
+			// targets and progress are the latest, temperatures the average
+			want:       []PrinterSample{{Time: 1000, ExtruderTemp: 205, ExtruderTarget: 215, BedTemp: 62, Progress: 0.3}},
+			wantMerged: 3,
+		},
+		{
+			name:       "new window starts a new slot",
+			size:       4,
+			resolution: 10,
+			add:        []PrinterSample{{Time: 1000, BedTemp: 60}, {Time: 1005, BedTemp: 70}, {Time: 1010, BedTemp: 80}},
+			want:       []PrinterSample{{Time: 1000, BedTemp: 65}, {Time: 1010, BedTemp: 80}},
+			wantMerged: 1,
+		},
+		{
+			name:       "older samples are dropped",
+			size:       4,
+			resolution: 10,
+			add:        []PrinterSample{{Time: 1020, BedTemp: 60}, {Time: 1000, BedTemp: 100}},
+			want:       []PrinterSample{{Time: 1020, BedTemp: 60}},
+			wantMerged: 1,
+		},
+		{
+			name:       "full ring overwrites the oldest",
+			size:       3,
+			resolution: 10,
+			add: []PrinterSample{
+				{Time: 1000, BedTemp: 1}, {Time: 1010, BedTemp: 2}, {Time: 1020, BedTemp: 3},
+				{Time: 1030, BedTemp: 4}, {Time: 1040, BedTemp: 5},
+			},
+			want:       []PrinterSample{{Time: 1020, BedTemp: 3}, {Time: 1030, BedTemp: 4}, {Time: 1040, BedTemp: 5}},
+			wantMerged: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &SampleRing{Resolution: tt.resolution, Samples: make([]PrinterSample, tt.size)}
+			for _, s := range tt.add {
+				r.add(s)
+			}
+			if got := r.between(0, 1<<62); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("samples = %+v, want %+v", got, tt.want)
+			}
+			if r.Merged != tt.wantMerged {
+				t.Errorf("merged = %d, want %d", r.Merged, tt.wantMerged)
+			}
+		})
+	}
+}
+
+func TestPrinterHistoryTiers(t *testing.T) {
+	h := newPrinterHistory()
+	wantSizes := []int{360, 1440, 1008}
+	for i, tier := range h.Tiers {
+		if len(tier.Samples) != wantSizes[i] {
+			t.Errorf("tier %d holds %d samples, want %d", tier.Resolution, len(tier.Samples), wantSizes[i])
+		}
+	}
+
+	// two hours of samples every 10s, the 10s tier only keeps the last hour
+	const start, end = int64(300 * 3600), int64(302 * 3600)
+	for ts := start; ts < end; ts += 10 {
+		h.record(PrinterSample{Time: ts, ExtruderTemp: float64(ts - start)})
+	}
+
+	tests := []struct {
+		name           string
+		from           int64
+		resolution     int64
+		wantResolution int64
+		wantSamples    int
+	}{
+		{"last half hour from the 10s tier", end - 1800, 0, 10, 180},
+		{"hour and a half from the 60s tier", end - 5400, 0, 60, 90},
+		{"everything from the 60s tier", start, 0, 60, 120},
+		{"before any sample from the 60s tier", start - 3600, 0, 60, 120},
+		{"coarser resolution averages down", end - 1800, 300, 300, 6},
+		{"finer than the tier keeps the tier", end - 5400, 10, 60, 90},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolution, samples := h.query(tt.from, end, tt.resolution)
+			if resolution != tt.wantResolution {
+				t.Errorf("resolution = %d, want %d", resolution, tt.wantResolution)
+			}
+			if len(samples) != tt.wantSamples {
+				t.Errorf("got %d samples, want %d", len(samples), tt.wantSamples)
+			}
+		})
+	}
+
+	// 10s samples 0..50 land in the first 60s slot
+	_, samples := h.query(start, start, 0)
+	if len(samples) != 1 || samples[0].ExtruderTemp != 25 {
+		t.Errorf("first 60s slot = %+v, want the average 25", samples)
+	}
+}
+
+func TestPrinterHistoryPersistence(t *testing.T) {
+	prevConfigPath, prevHistories := configPath, PrinterHistories
+	t.Cleanup(func() {
+		configPath, PrinterHistories = prevConfigPath, prevHistories
+	})
+	configPath = filepath.Join(t.TempDir(), "guppytunnel.json")
+	PrinterHistories = make(map[string]*PrinterHistory)
+
+	HistoryLock.Lock()
+	h := getPrinterHistory("p1")
+	h.record(PrinterSample{Time: 1000, BedTemp: 60})
+	h.record(PrinterSample{Time: 1001, BedTemp: 62})
+	h.record(PrinterSample{Time: 1070, BedTemp: 70})
+	HistoryLock.Unlock()
+
+	savePrinterHistories()
+	if h.dirty {
+		t.Error("history still dirty after saving")
+	}
+
+	// a restart starts with an empty map and loads from disk
+	PrinterHistories = make(map[string]*PrinterHistory)
+	HistoryLock.Lock()
+	loaded := getPrinterHistory("p1")
+	HistoryLock.Unlock()
+
+	for i := range h.Tiers {
+		if !reflect.DeepEqual(loaded.Tiers[i], h.Tiers[i]) {
+			t.Errorf("tier %d differs after reload: %+v, want %+v", h.Tiers[i].Resolution,
+				loaded.Tiers[i].between(0, 1<<62), h.Tiers[i].between(0, 1<<62))
+		}
+	}
+
+	// the 600s slot holds three samples, the next one averages with all of them
+	loaded.record(PrinterSample{Time: 1080, BedTemp: 80})
+	if newest := loaded.Tiers[2].newest(); newest.BedTemp != 68 {
+		t.Errorf("600s slot after reload = %+v, want the average 68", newest)
+	}
+}
+
+func TestParseListParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{}},
+		{"printer=a", []string{"a"}},
+		{"printer=a&printer=b", []string{"a", "b"}},
+		{"printer=a,b", []string{"a", "b"}},
+		{"printer=a,%20b,,&printer=c", []string{"a", "b", "c"}},
+		{"status=completed", []string{}},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		if got := parseListParam(r, "printer"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseListParam(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// transports of printers with custom tls settings, keyed by printer id
+	MoonrakerTransports     = make(map[string]http.RoundTripper)
+	MoonrakerTransportsLock sync.Mutex
+)
+
+// parses moonraker_url and fills in moonraker_ip/moonraker_port from it, those
+// are still used for camera discovery and by clients that only know ip:port
+func normalizePrinterUrl(p *GTPrinterConfig) error {
+	if p.MoonrakerUrl == "" {
+		return nil
+	}
+
+	u, err := url.Parse(p.MoonrakerUrl)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("moonraker url %s must be an absolute http(s) url", p.MoonrakerUrl)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("moonraker url %s can't have a query or fragment", p.MoonrakerUrl)
+	}
+
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return err
+		}
+	}
+
+	p.MoonrakerUrl = strings.TrimSuffix(u.String(), "/")
+	p.MoonrakerIP = u.Hostname()
+	p.MoonrakerPort = port
+	return nil
+}
+
+// base url of the printer's moonraker without a trailing slash
+func moonrakerBaseUrl(p GTPrinterConfig) string {
+	if p.MoonrakerUrl != "" {
+		return strings.TrimSuffix(p.MoonrakerUrl, "/")
+	}
+	return fmt.Sprintf("http://%s:%d", p.MoonrakerIP, p.MoonrakerPort)
+}
+
+func hasCustomTls(p GTPrinterConfig) bool {
+	return p.MoonrakerCA != "" || (p.InsecureSkipVerify != nil && *p.InsecureSkipVerify)
+}
+
+func isPemCA(ca string) bool {
+	return strings.Contains(ca, "-----BEGIN")
+}
+
+// moonraker_ca is either the PEM itself or, in guppytunnel.json only, a path to a PEM file
+func loadMoonrakerCA(ca string) (*x509.CertPool, error) {
+	pem := []byte(ca)
+	if !isPemCA(ca) {
+		content, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pem = content
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in moonraker_ca")
+	}
+	return pool, nil
+}
+
+func newMoonrakerTransport(p GTPrinterConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: p.InsecureSkipVerify != nil && *p.InsecureSkipVerify,
+	}
+	if p.MoonrakerCA != "" {
+		pool, err := loadMoonrakerCA(p.MoonrakerCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+func getMoonrakerTransport(p GTPrinterConfig) (http.RoundTripper, error) {
+	if !hasCustomTls(p) {
+		return http.DefaultTransport, nil
+	}
+
+	printerId := getPrinterId(p)
+	MoonrakerTransportsLock.Lock()
+	defer MoonrakerTransportsLock.Unlock()
+	if transport, exists := MoonrakerTransports[printerId]; exists {
+		return transport, nil
+	}
+
+	transport, err := newMoonrakerTransport(p)
+	if err != nil {
+		return nil, err
+	}
+	MoonrakerTransports[printerId] = transport
+	return transport, nil
+}
+
+// drops the cached transport, e.g. after the printer's tls settings changed
+func resetMoonrakerTransport(printerId string) {
+	MoonrakerTransportsLock.Lock()
+	defer MoonrakerTransportsLock.Unlock()
+	if transport, exists := MoonrakerTransports[printerId]; exists {
+		transport.(*http.Transport).CloseIdleConnections()
+		delete(MoonrakerTransports, printerId)
+	}
+}
+
+// same timeout as the shared client but with the printer's tls settings
+func moonrakerClient(p GTPrinterConfig) (*http.Client, error) {
+	transport, err := getMoonrakerTransport(p)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: client.Timeout, Transport: transport}, nil
+}
+
+// round tripper for the moonraker reverse proxy, the printer config is looked
+// up per request so tls changes apply without recreating the routes
+type printerTransport string
+
+func (printerId printerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	PrintersMapLock.RLock()
+	printer, exists := Printers[string(printerId)]
+	PrintersMapLock.RUnlock()
+	if !exists {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	transport, err := getMoonrakerTransport(printer.PrinterInfo)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
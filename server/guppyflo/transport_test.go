@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoonrakerCAPaths(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	t.Cleanup(srv.Close)
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte(ca), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// guppytunnel.json may point at a file
+	if _, err := loadMoonrakerCA(caFile); err != nil {
+		t.Errorf("loading the CA from a file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ca      string
+		wantErr bool
+	}{
+		{"pem", ca, false},
+		{"file path", caFile, true},
+		{"system file", "/etc/passwd", true},
+		{"broken pem", "-----BEGIN CERTIFICATE-----\nnope\n-----END CERTIFICATE-----\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := GTPrinterConfig{MoonrakerIP: "127.0.0.1", MoonrakerPort: 7125, MoonrakerCA: tt.ca}
+			if err := validatePrinterConfig(&p); (err != nil) != tt.wantErr {
+				t.Errorf("validatePrinterConfig() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
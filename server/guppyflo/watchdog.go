@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AlertTemperatureDeviation = "temperature_deviation"
+	AlertHeaterIdle           = "heater_idle"
+	AlertTargetWithoutPrint   = "target_without_print"
+	AlertStalled              = "stalled"
+
+	defaultStallTimeout   = 30 * time.Minute
+	watchdogSweepInterval = 30 * time.Second
+
+	WatchdogPause         = ActionPause
+	WatchdogEmergencyStop = ActionEmergencyStop
+)
+
+var WatchdogActions = []string{WatchdogPause, WatchdogEmergencyStop}
+
+type PrinterAlert struct {
+	Id        string `json:"id"`
+	PrinterId string `json:"printer_id"`
+	Rule      string `json:"rule"`
+	Heater    string `json:"heater,omitempty"`
+	Message   string `json:"message"`
+	Since     int64  `json:"since"`
+	// action run when the alert was raised and its outcome
+	Action      string `json:"action,omitempty"`
+	ActionError string `json:"action_error,omitempty"`
+}
+
+type heaterReading struct {
+	name        string
+	temperature float64
+	target      float64
+}
+
+type watchdogState struct {
+	// when each condition (rule:heater) started to hold
+	conditions map[string]time.Time
+	// heaters that got within the allowed deviation since their target was set
+	reached map[string]float64
+	alerts  map[string]PrinterAlert
+
+	// last file position seen while printing and when it last moved
+	filename      string
+	position      int
+	printDuration float64
+	lastAdvance   time.Time
+}
+
+var (
+	WatchdogStates     = make(map[string]*watchdogState)
+	WatchdogStatesLock sync.Mutex
+)
+
+// callers must hold WatchdogStatesLock
+func getWatchdogState(printerId string) *watchdogState {
+	s, exists := WatchdogStates[printerId]
+	if !exists {
+		s = &watchdogState{
+			conditions: make(map[string]time.Time),
+			reached:    make(map[string]float64),
+			alerts:     make(map[string]PrinterAlert),
+		}
+		WatchdogStates[printerId] = s
+	}
+	return s
+}
+
+func heaterReadings(p PrinterInfoStatsPair) []heaterReading {
+	readings := make([]heaterReading, 0, len(p.Tools)+1)
+	for _, t := range p.Tools {
+		readings = append(readings, heaterReading{t.Name, t.Temperature, t.Target})
+	}
+	if len(p.Tools) == 0 {
+		readings = append(readings, heaterReading{"extruder", p.Extruder.Temperature, p.Extruder.Target})
+	}
+	return append(readings, heaterReading{"heater_bed", p.HeaterBed.Temperature, p.HeaterBed.Target})
+}
+
+func isPrintActive(state string) bool {
+	return state == "printing" || state == "paused"
+}
+
+// holds reports whether the condition has been true for at least d, tracking when it started
+func (s *watchdogState) holds(key string, condition bool, d time.Duration, now time.Time) bool {
+	if !condition {
+		delete(s.conditions, key)
+		return false
+	}
+	since, exists := s.conditions[key]
+	if !exists {
+		s.conditions[key] = now
+		since = now
+	}
+	return now.Sub(since) >= d
+}
+
+// matching conditions keyed by rule:heater with their alert message
+func (s *watchdogState) evaluateRules(c GTWatchdogConfig, p PrinterInfoStatsPair, now time.Time) map[string]PrinterAlert {
+	matched := make(map[string]PrinterAlert)
+	match := func(rule string, heater string, message string) {
+		matched[rule+":"+heater] = PrinterAlert{Rule: rule, Heater: heater, Message: message}
+	}
+
+	for _, h := range heaterReadings(p) {
+		if c.DeviationC > 0 {
+			// heating up isn't a deviation, only start watching once the target was reached
+			if h.target <= 0 || s.reached[h.name] != h.target {
+				delete(s.reached, h.name)
+			}
+			if h.target > 0 && math.Abs(h.temperature-h.target) <= c.DeviationC {
+				s.reached[h.name] = h.target
+			}
+			_, reached := s.reached[h.name]
+			deviated := reached && math.Abs(h.temperature-h.target) > c.DeviationC
+			if s.holds(AlertTemperatureDeviation+":"+h.name, deviated, time.Duration(c.DeviationSeconds)*time.Second, now) {
+				match(AlertTemperatureDeviation, h.name, fmt.Sprintf("%s is at %.1f°C, more than %.0f°C off its %.0f°C target",
+					h.name, h.temperature, c.DeviationC, h.target))
+			}
+		}
+
+		if c.IdleMaxC > 0 {
+			// whatever the target, a stuck ssr reads as off and a forgotten target as on
+			hot := !isPrintActive(p.Stats.State) && h.temperature > c.IdleMaxC
+			if s.holds(AlertHeaterIdle+":"+h.name, hot, time.Duration(c.IdleSeconds)*time.Second, now) {
+				message := fmt.Sprintf("%s is at %.1f°C with its heater off and no print running", h.name, h.temperature)
+				if h.target > 0 {
+					message = fmt.Sprintf("%s is at %.1f°C with a %.0f°C target and no print running", h.name, h.temperature, h.target)
+				}
+				match(AlertHeaterIdle, h.name, message)
+			}
+		}
+
+		if c.TargetWithoutPrintSeconds > 0 {
+			heating := h.target > 0 && !isPrintActive(p.Stats.State)
+			if s.holds(AlertTargetWithoutPrint+":"+h.name, heating, time.Duration(c.TargetWithoutPrintSeconds)*time.Second, now) {
+				match(AlertTargetWithoutPrint, h.name, fmt.Sprintf("%s has a %.0f°C target but no print is running", h.name, h.target))
+			}
+		}
+	}
+	return matched
+}
+
+func stallTimeout(c *GTWatchdogConfig) time.Duration {
+	if c == nil || c.StallSeconds == 0 {
+		return defaultStallTimeout
+	}
+	return time.Duration(c.StallSeconds) * time.Second
+}
+
+// a print counts as stalled when klipper says printing but the file position
+// hasn't moved for the stall timeout. print_duration tells a print stuck in a
+// wait or macro (still counting) from one that stopped getting updates.
+func (s *watchdogState) evaluateStall(c *GTWatchdogConfig, p PrinterInfoStatsPair, now time.Time) (PrinterAlert, bool) {
+	if p.Stats.State != "printing" || stallTimeout(c) < 0 {
+		s.lastAdvance = time.Time{}
+		return PrinterAlert{}, false
+	}
+
+	if s.lastAdvance.IsZero() || p.Stats.Filename != s.filename || p.SDCard.FilePosition != s.position {
+		s.filename = p.Stats.Filename
+		s.position = p.SDCard.FilePosition
+		s.printDuration = p.Stats.PrintDuration
+		s.lastAdvance = now
+		return PrinterAlert{}, false
+	}
+
+	stalledFor := now.Sub(s.lastAdvance)
+	if stalledFor < stallTimeout(c) {
+		return PrinterAlert{}, false
+	}
+
+	message := fmt.Sprintf("no progress for %s at file position %d", stalledFor.Truncate(time.Second), s.position)
+	if p.Stats.PrintDuration > s.printDuration {
+		message += fmt.Sprintf(", print time advanced by %s", (time.Duration(p.Stats.PrintDuration-s.printDuration) * time.Second).String())
+	} else {
+		message += ", print time stopped too"
+	}
+	return PrinterAlert{Rule: AlertStalled, Message: message}, true
+}
+
+// evaluates the printer's watchdog rules, returns the active alerts and the ones raised just now
+func evaluateWatchdog(p PrinterInfoStatsPair) ([]PrinterAlert, []PrinterAlert) {
+	WatchdogStatesLock.Lock()
+	defer WatchdogStatesLock.Unlock()
+
+	if p.Stats.State == "offline" {
+		// nothing to judge an unreachable printer by
+		delete(WatchdogStates, p.PrinterId)
+		return nil, nil
+	}
+
+	c := p.PrinterInfo.Watchdog
+	s := getWatchdogState(p.PrinterId)
+	now := time.Now()
+	matched := make(map[string]PrinterAlert)
+	if c != nil {
+		matched = s.evaluateRules(*c, p, now)
+	}
+	if alert, stalled := s.evaluateStall(c, p, now); stalled {
+		matched[AlertStalled] = alert
+	}
+
+	raised := make([]PrinterAlert, 0)
+	for key := range s.alerts {
+		if _, exists := matched[key]; !exists {
+			delete(s.alerts, key)
+		}
+	}
+	for key, alert := range matched {
+		if existing, exists := s.alerts[key]; exists {
+			// keep the id and start time, refresh the reading
+			existing.Message = alert.Message
+			s.alerts[key] = existing
+			continue
+		}
+
+		alert.Id = newEventId()
+		alert.PrinterId = p.PrinterId
+		alert.Since = now.Unix()
+		// a stalled print may just be waiting on something, actions are for thermal problems
+		if c != nil && alert.Rule != AlertStalled {
+			alert.Action = c.Action
+		}
+		if alert.Action == WatchdogPause && !isPrintActive(p.Stats.State) {
+			alert.Action = ""
+		}
+		s.alerts[key] = alert
+		raised = append(raised, alert)
+	}
+
+	return sortedAlerts(s.alerts), raised
+}
+
+func sortedAlerts(alerts map[string]PrinterAlert) []PrinterAlert {
+	if len(alerts) == 0 {
+		return nil
+	}
+	sorted := make([]PrinterAlert, 0, len(alerts))
+	for _, a := range alerts {
+		sorted = append(sorted, a)
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		if sorted[a].Since != sorted[b].Since {
+			return sorted[a].Since < sorted[b].Since
+		}
+		return sorted[a].Rule+sorted[a].Heater < sorted[b].Rule+sorted[b].Heater
+	})
+	return sorted
+}
+
+// records the outcome of an alert's action so the api shows whether it worked
+func setAlertActionError(printerId string, alertId string, err error) {
+	WatchdogStatesLock.Lock()
+	defer WatchdogStatesLock.Unlock()
+	s, exists := WatchdogStates[printerId]
+	if !exists {
+		return
+	}
+	for key, a := range s.alerts {
+		if a.Id == alertId {
+			a.ActionError = err.Error()
+			s.alerts[key] = a
+		}
+	}
+}
+
+func deletePrinterWatchdog(printerId string) {
+	WatchdogStatesLock.Lock()
+	defer WatchdogStatesLock.Unlock()
+	delete(WatchdogStates, printerId)
+}
+
+// emits alert events and runs their actions without holding up the consumer
+func raiseAlerts(p PrinterInfoStatsPair, raised []PrinterAlert) {
+	for _, alert := range raised {
+		log.Println("Watchdog alert for printer", p.PrinterId, alert.Message)
+		emitPrinterEvents([]PrinterEvent{newAlertEvent(alert, p)})
+
+		if alert.Action == "" {
+			continue
+		}
+		go func(alert PrinterAlert) {
+			if err := sendPrinterAction(p.PrinterInfo, alert.Action); err != nil {
+				log.Println("Watchdog action", alert.Action, "failed for printer", p.PrinterId, err)
+				setAlertActionError(p.PrinterId, alert.Id, err)
+			}
+		}(alert)
+	}
+}
+
+func isStalled(alerts []PrinterAlert) bool {
+	return slices.ContainsFunc(alerts, func(a PrinterAlert) bool {
+		return a.Rule == AlertStalled
+	})
+}
+
+// time based rules have to fire even when a printer stops sending updates
+func startWatchdogSweeper() {
+	go func() {
+		for range time.Tick(watchdogSweepInterval) {
+			type raisedAlerts = Pair[PrinterInfoStatsPair, []PrinterAlert]
+			pending := make([]raisedAlerts, 0)
+
+			PrintersMapLock.Lock()
+			for id, p := range Printers {
+				alerts, raised := evaluateWatchdog(p)
+				p.Alerts = alerts
+				p.Stalled = isStalled(alerts)
+				Printers[id] = p
+				PrinterStream.publishPrinter(p)
+				if len(raised) > 0 {
+					pending = append(pending, raisedAlerts{First: p, Second: raised})
+				}
+			}
+			PrintersMapLock.Unlock()
+
+			for _, r := range pending {
+				raiseAlerts(r.First, r.Second)
+			}
+		}
+	}()
+}
+
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	printerIds := parseListParam(r, "printer")
+
+	PrintersMapLock.RLock()
+	alerts := make([]PrinterAlert, 0)
+	for _, p := range getSortedPrinters() {
+		if len(printerIds) > 0 && !slices.Contains(printerIds, p.PrinterId) {
+			continue
+		}
+		alerts = append(alerts, p.Alerts...)
+	}
+	PrintersMapLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&alerts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+type watchdogStep struct {
+	// seconds since the first step
+	at       int
+	state    string
+	temp     float64
+	target   float64
+	position int
+	want     []string
+}
+
+func watchdogTestPair(s watchdogStep) PrinterInfoStatsPair {
+	return PrinterInfoStatsPair{
+		PrinterId: "p1",
+		Stats:     PrinterStats{State: s.state, Filename: "a.gcode"},
+		SDCard:    VirtualSDCard{FilePosition: s.position},
+		Extruder:  ExtruderStats{Temperature: s.temp, Target: s.target},
+		// the bed stays cold and off so only the extruder matters
+		HeaterBed: HeaterBedStats{Temperature: 25},
+	}
+}
+
+func newTestWatchdogState() *watchdogState {
+	return &watchdogState{
+		conditions: make(map[string]time.Time),
+		reached:    make(map[string]float64),
+		alerts:     make(map[string]PrinterAlert),
+	}
+}
+
+func TestWatchdogRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		config GTWatchdogConfig
+		steps  []watchdogStep
+	}{
+		{
+			name:   "heating up isn't a deviation",
+			config: GTWatchdogConfig{DeviationC: 10, DeviationSeconds: 30},
+			steps: []watchdogStep{
+				{at: 0, state: "printing", temp: 25, target: 210},
+				{at: 120, state: "printing", temp: 150, target: 210},
+			},
+		},
+		{
+			name:   "deviation after reaching the target",
+			config: GTWatchdogConfig{DeviationC: 10, DeviationSeconds: 30},
+			steps: []watchdogStep{
+				{at: 0, state: "printing", temp: 205, target: 210},
+				{at: 10, state: "printing", temp: 180, target: 210},
+				{at: 30, state: "printing", temp: 180, target: 210},
+				{at: 40, state: "printing", temp: 180, target: 210, want: []string{"temperature_deviation:extruder"}},
+				{at: 50, state: "printing", temp: 208, target: 210},
+			},
+		},
+		{
+			name:   "a new target has to be reached again",
+			config: GTWatchdogConfig{DeviationC: 10, DeviationSeconds: 30},
+			steps: []watchdogStep{
+				{at: 0, state: "printing", temp: 205, target: 210},
+				{at: 10, state: "printing", temp: 205, target: 250},
+				{at: 100, state: "printing", temp: 220, target: 250},
+			},
+		},
+		{
+			name:   "hot with the heater off",
+			config: GTWatchdogConfig{IdleMaxC: 80, IdleSeconds: 60},
+			steps: []watchdogStep{
+				{at: 0, state: "standby", temp: 120},
+				{at: 30, state: "standby", temp: 110},
+				{at: 60, state: "standby", temp: 100, want: []string{"heater_idle:extruder"}},
+				{at: 90, state: "standby", temp: 70},
+			},
+		},
+		{
+			name:   "hot with a target left on",
+			config: GTWatchdogConfig{IdleMaxC: 80, IdleSeconds: 60},
+			steps: []watchdogStep{
+				{at: 0, state: "complete", temp: 210, target: 210},
+				{at: 60, state: "complete", temp: 210, target: 210, want: []string{"heater_idle:extruder"}},
+			},
+		},
+		{
+			name:   "hot while printing is expected",
+			config: GTWatchdogConfig{IdleMaxC: 80, IdleSeconds: 60},
+			steps: []watchdogStep{
+				{at: 0, state: "printing", temp: 210, target: 210},
+				{at: 120, state: "paused", temp: 210, target: 210},
+			},
+		},
+		{
+			name:   "target without a print",
+			config: GTWatchdogConfig{TargetWithoutPrintSeconds: 300},
+			steps: []watchdogStep{
+				{at: 0, state: "standby", temp: 25, target: 200},
+				{at: 300, state: "standby", temp: 200, target: 200, want: []string{"target_without_print:extruder"}},
+				{at: 310, state: "printing", temp: 200, target: 200},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestWatchdogState()
+			start := time.Unix(1000, 0)
+			for i, step := range tt.steps {
+				matched := s.evaluateRules(tt.config, watchdogTestPair(step), start.Add(time.Duration(step.at)*time.Second))
+				got := make([]string, 0)
+				for key := range matched {
+					got = append(got, key)
+				}
+				slices.Sort(got)
+				want := step.want
+				if want == nil {
+					want = []string{}
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("step %d at %ds: matched %v, want %v", i, step.at, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchdogStall(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *GTWatchdogConfig
+		steps  []watchdogStep
+	}{
+		{
+			name: "default timeout",
+			steps: []watchdogStep{
+				{at: 0, state: "printing", position: 100},
+				{at: 1799, state: "printing", position: 100},
+				{at: 1800, state: "printing", position: 100, want: []string{AlertStalled}},
+			},
+		},
+		{
+			name:   "moving file position resets the timer",
+			config: &GTWatchdogConfig{StallSeconds: 60},
+			steps: []watchdogStep{
+				{at: 0, state: "printing", position: 100},
+				{at: 50, state: "printing", position: 200},
+				{at: 100, state: "printing", position: 200},
+				{at: 110, state: "printing", position: 200, want: []string{AlertStalled}},
+			},
+		},
+		{
+			name:   "paused isn't stalled",
+			config: &GTWatchdogConfig{StallSeconds: 60},
+			steps: []watchdogStep{
+				{at: 0, state: "printing", position: 100},
+				{at: 30, state: "paused", position: 100},
+				{at: 120, state: "paused", position: 100},
+				{at: 150, state: "printing", position: 100},
+			},
+		},
+		{
+			name:   "turned off",
+			config: &GTWatchdogConfig{StallSeconds: -1},
+			steps: []watchdogStep{
+				{at: 0, state: "printing", position: 100},
+				{at: 7200, state: "printing", position: 100},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestWatchdogState()
+			start := time.Unix(1000, 0)
+			for i, step := range tt.steps {
+				alert, stalled := s.evaluateStall(tt.config, watchdogTestPair(step), start.Add(time.Duration(step.at)*time.Second))
+				if stalled != (len(step.want) > 0) {
+					t.Errorf("step %d at %ds: stalled = %v (%s), want %v", i, step.at, stalled, alert.Message, step.want)
+				}
+				if stalled && alert.Rule != AlertStalled {
+					t.Errorf("step %d: rule = %s, want %s", i, alert.Rule, AlertStalled)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	webhookMaxAttempts  = 5
+	webhookRetryBackoff = 2 * time.Second
+)
+
+var webhookClient = http.Client{Timeout: 10 * time.Second}
+
+// empty filters match everything
+func eventMatches(e PrinterEvent, events []string, printers []string) bool {
+	if len(events) > 0 && !slices.Contains(events, e.Type) {
+		return false
+	}
+	if len(printers) > 0 && !slices.Contains(printers, e.Printer.Id) {
+		return false
+	}
+	return true
+}
+
+// hex HMAC-SHA256 of "<timestamp>.<body>", sent as "sha256=<hex>". the timestamp
+// is signed too so receivers can reject old deliveries that are replayed.
+func signPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliverWebhooks(e PrinterEvent) {
+	GTConfigLock.RLock()
+	webhooks := slices.Clone(gtconfig.Webhooks)
+	GTConfigLock.RUnlock()
+
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Failed to encode event", e.Type, err)
+		return
+	}
+
+	for _, w := range webhooks {
+		if eventMatches(e, w.Events, w.Printers) {
+			go deliverWebhook(w, e, body)
+		}
+	}
+}
+
+// retries with exponential backoff on network errors, 5xx and 429. other 4xx
+// mean the receiver doesn't want it, retrying won't help.
+func deliverWebhook(w GTWebhookConfig, e PrinterEvent, body []byte) {
+	backoff := webhookRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(w, e, body)
+		if err == nil {
+			return
+		}
+
+		var whErr *webhookError
+		if attempt >= webhookMaxAttempts || (errors.As(err, &whErr) && !whErr.retryable) {
+			log.Println("Failed to deliver", e.Type, "webhook to", w.Url, err)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+type webhookError struct {
+	status    string
+	retryable bool
+}
+
+func (e *webhookError) Error() string {
+	return "webhook responded with " + e.status
+}
+
+func postWebhook(w GTWebhookConfig, e PrinterEvent, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{status: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GuppyFLO")
+	req.Header.Set("X-GuppyFLO-Event", e.Type)
+	req.Header.Set("X-GuppyFLO-Delivery", e.Id)
+	// when this attempt was sent, retries get a fresh one
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	req.Header.Set("X-GuppyFLO-Timestamp", timestamp)
+	if w.Secret != "" {
+		req.Header.Set("X-GuppyFLO-Signature", signPayload(w.Secret, timestamp, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &webhookError{
+		status:    resp.Status,
+		retryable: resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+	}
+}